@@ -0,0 +1,72 @@
+package compress
+
+import (
+	"sync"
+)
+
+const (
+	// anomalyWarmup is the number of responses a route needs before its
+	// baseline is trusted.
+	anomalyWarmup = 20
+	// anomalyWeight is the weight of each new ratio in the moving average.
+	anomalyWeight = 0.1
+	// maxBaselines caps the number of routes tracked. Without a route
+	// pattern, as under Wrap, routes are request paths, which clients
+	// choose.
+	maxBaselines = 10000
+)
+
+// detector keeps a moving average of the compression ratio per route and
+// flags ratios that stray too far from it.
+type detector struct {
+	factor float64
+
+	mu        sync.Mutex
+	baselines map[string]*baseline
+}
+
+type baseline struct {
+	mean float64
+	n    int
+}
+
+func newDetector(factor float64) *detector {
+	return &detector{
+		factor:    factor,
+		baselines: make(map[string]*baseline),
+	}
+}
+
+// observe adds ratio to the baseline of route. It returns the baseline from
+// before and whether ratio differs from it by more than the factor, either
+// way.
+func (d *detector) observe(route string, ratio float64) (float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, ok := d.baselines[route]
+	if !ok {
+		if len(d.baselines) >= maxBaselines {
+			d.prune()
+			if len(d.baselines) >= maxBaselines {
+				return ratio, false
+			}
+		}
+		d.baselines[route] = &baseline{mean: ratio, n: 1}
+		return ratio, false
+	}
+	mean := b.mean
+	anomalous := b.n >= anomalyWarmup && mean > 0 && (ratio > mean*d.factor || ratio < mean/d.factor)
+	b.mean += (ratio - b.mean) * anomalyWeight
+	b.n++
+	return mean, anomalous
+}
+
+// prune drops the baselines still warming up, such as those of paths
+// requested once, keeping those that are trusted.
+func (d *detector) prune() {
+	for route, b := range d.baselines {
+		if b.n < anomalyWarmup {
+			delete(d.baselines, route)
+		}
+	}
+}
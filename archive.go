@@ -0,0 +1,244 @@
+package compress
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/goroute/route"
+)
+
+// ZipFile is a file of an archive streamed by WriteZip.
+type ZipFile struct {
+	// Name is the slash-separated path of the file in the archive.
+	Name string
+
+	// Modified is the modification time of the file.
+	// Optional. Default value the time of the request.
+	Modified time.Time
+
+	// Open returns the content of the file. It is called when the file is
+	// written, and the result closed once copied.
+	Open func() (io.ReadCloser, error)
+}
+
+// Zip returns a handler that streams a ZIP archive of the directory root of
+// fsys, named after root, as a download. Files are read and compressed as
+// the archive is written, without temporary files. It replies 404 Not Found
+// if root does not exist.
+func Zip(fsys fs.FS, root string) route.HandlerFunc {
+	return func(c route.Context) error {
+		if _, err := fs.Stat(fsys, root); err != nil {
+			return archiveError(err)
+		}
+		var files []ZipFile
+		err := walkArchive(fsys, root, func(name, p string, d fs.DirEntry, info fs.FileInfo) error {
+			if d.IsDir() {
+				name += "/"
+			}
+			f := ZipFile{Name: name, Modified: info.ModTime()}
+			if !d.IsDir() {
+				f.Open = func() (io.ReadCloser, error) {
+					return fsys.Open(p)
+				}
+			}
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return WriteZip(c, archiveName(root)+".zip", files...)
+	}
+}
+
+// WriteZip streams a ZIP archive of files to the response as a download
+// named name. Files whose Name ends with a slash are directories, and have
+// no Open. Once the response has started, an error can only cut the archive
+// short: it is returned for the caller to log.
+//
+// The archive is compressed already, so the response is marked no-transform
+// for Gzip middleware and proxies to leave it as is.
+func WriteZip(c route.Context, name string, files ...ZipFile) error {
+	startArchive(c, name, "application/zip")
+	zw := zip.NewWriter(c.Response())
+	zw.RegisterCompressor(zip.Deflate, newPooledFlateWriter)
+	now := time.Now()
+	for _, f := range files {
+		hdr := &zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified}
+		if hdr.Modified.IsZero() {
+			hdr.Modified = now
+		}
+		if f.Open == nil {
+			hdr.Method = zip.Store
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if f.Open == nil {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// TarGz returns a handler that streams a gzip-compressed tarball of the
+// directory root of fsys, named after root, as a download. Files are read
+// one at a time and compressed as the archive is written, with a gzip writer
+// from the pool the middleware uses, so memory stays bounded whatever the
+// size of the tree. It replies 404 Not Found if root does not exist. Once
+// the response has started, an error can only cut the archive short: it is
+// returned for the caller to log.
+//
+// The response is marked no-transform, like the one of WriteZip.
+func TarGz(fsys fs.FS, root string) route.HandlerFunc {
+	return func(c route.Context) error {
+		if _, err := fs.Stat(fsys, root); err != nil {
+			return archiveError(err)
+		}
+		startArchive(c, archiveName(root)+".tar.gz", "application/gzip")
+		pool := &gzipWriters[gzip.DefaultCompression-gzip.HuffmanOnly]
+		var gw *gzip.Writer
+		if v := pool.Get(); v != nil {
+			gw = v.(*gzip.Writer)
+			gw.Reset(c.Response())
+		} else {
+			gw = gzip.NewWriter(c.Response())
+		}
+		defer func() {
+			// Whatever the outcome, the writer must not keep the response.
+			gw.Reset(io.Discard)
+			pool.Put(gw)
+		}()
+		tw := tar.NewWriter(gw)
+		err := walkArchive(fsys, root, func(name, p string, d fs.DirEntry, info fs.FileInfo) error {
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = name
+			if d.IsDir() {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			f, err := fsys.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil {
+			err = gw.Close()
+		}
+		return err
+	}
+}
+
+// walkArchive calls fn for the files and directories under root, with
+// their slash-separated name relative to root and their path in fsys.
+func walkArchive(fsys fs.FS, root string, fn func(name, p string, d fs.DirEntry, info fs.FileInfo) error) error {
+	return fs.WalkDir(fsys, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root && d.IsDir() {
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			// Symbolic links, devices and the like are left out.
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if p != root {
+			name = p[len(root)+1:]
+			if root == "." {
+				name = p
+			}
+		}
+		return fn(name, p, d, info)
+	})
+}
+
+// startArchive sends the headers of an archive download named name.
+func startArchive(c route.Context, name, contentType string) {
+	h := c.Response().Header()
+	h.Set(route.HeaderContentType, contentType)
+	// The name is quoted as RFC 6266 has it, in filename* if not ASCII.
+	h.Set(route.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	h.Add(headerCacheControl, "no-transform")
+	c.Response().WriteHeader(http.StatusOK)
+}
+
+// archiveName returns the name of the archive of root, without extension.
+func archiveName(root string) string {
+	if name := path.Base(root); name != "." && name != "/" {
+		return name
+	}
+	return "archive"
+}
+
+// archiveError maps the error of looking up the root of an archive to an
+// HTTP error.
+func archiveError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return route.ErrNotFound
+	}
+	return err
+}
+
+// pooledFlateWriter returns its flate writer to the pool once closed.
+type pooledFlateWriter struct {
+	*flate.Writer
+}
+
+// newPooledFlateWriter returns a flate writer at the default level, taken
+// from the pool shared with WebSocketDeflate.
+func newPooledFlateWriter(w io.Writer) (io.WriteCloser, error) {
+	pool := &flateWriters[flate.DefaultCompression-flate.HuffmanOnly]
+	if v := pool.Get(); v != nil {
+		fw := v.(*flate.Writer)
+		fw.Reset(w)
+		return pooledFlateWriter{fw}, nil
+	}
+	fw, err := flate.NewWriter(w, flate.DefaultCompression)
+	return pooledFlateWriter{fw}, err
+}
+
+func (w pooledFlateWriter) Close() error {
+	err := w.Writer.Close()
+	w.Writer.Reset(io.Discard)
+	flateWriters[flate.DefaultCompression-flate.HuffmanOnly].Put(w.Writer)
+	return err
+}
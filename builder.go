@@ -0,0 +1,304 @@
+package compress
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/goroute/route"
+)
+
+// OptionsBuilder configures the middleware with chained method calls, as an
+// alternative to passing options to New:
+//
+//	mw, err := compress.Builder().Gzip(6).MinLength(1024).Build()
+//
+// Each method sets the option of the same name; Gzip sets Level.
+type OptionsBuilder struct {
+	options []Option
+}
+
+// Builder returns an OptionsBuilder starting from the default options.
+func Builder() *OptionsBuilder {
+	return new(OptionsBuilder)
+}
+
+// With adds options to b.
+func (b *OptionsBuilder) With(options ...Option) *OptionsBuilder {
+	b.options = append(b.options, options...)
+	return b
+}
+
+// Options returns the default options with those of b applied.
+func (b *OptionsBuilder) Options() Options {
+	opts := GetDefaultOptions()
+	for _, opt := range b.options {
+		opt(&opts)
+	}
+	return opts
+}
+
+// Build returns Gzip middleware configured by b. It returns the error of
+// Options.Validate if the options are invalid.
+func (b *OptionsBuilder) Build() (route.MiddlewareFunc, error) {
+	return NewWithOptions(b.Options())
+}
+
+// Skipper sets the Skipper option.
+func (b *OptionsBuilder) Skipper(skipper route.Skipper) *OptionsBuilder {
+	return b.With(Skipper(skipper))
+}
+
+// Gzip sets the Level option.
+func (b *OptionsBuilder) Gzip(level int) *OptionsBuilder {
+	return b.With(Level(level))
+}
+
+// ETag sets the ETag option.
+func (b *OptionsBuilder) ETag(strategy ETagStrategy) *OptionsBuilder {
+	return b.With(ETag(strategy))
+}
+
+// ComputeETag sets the ComputeETag option.
+func (b *OptionsBuilder) ComputeETag(compute bool) *OptionsBuilder {
+	return b.With(ComputeETag(compute))
+}
+
+// Buffer sets the Buffer option.
+func (b *OptionsBuilder) Buffer(buffer bool) *OptionsBuilder {
+	return b.With(Buffer(buffer))
+}
+
+// Digest sets the Digest option.
+func (b *OptionsBuilder) Digest(algorithms ...string) *OptionsBuilder {
+	return b.With(Digest(algorithms...))
+}
+
+// UncompressedLengthHeader sets the UncompressedLengthHeader option.
+func (b *OptionsBuilder) UncompressedLengthHeader(name string) *OptionsBuilder {
+	return b.With(UncompressedLengthHeader(name))
+}
+
+// HTTP2Buffer sets the HTTP2Buffer option.
+func (b *OptionsBuilder) HTTP2Buffer(buffer bool) *OptionsBuilder {
+	return b.With(HTTP2Buffer(buffer))
+}
+
+// StatsTrailers sets the StatsTrailers option.
+func (b *OptionsBuilder) StatsTrailers(send bool) *OptionsBuilder {
+	return b.With(StatsTrailers(send))
+}
+
+// DebugHeader sets the DebugHeader option.
+func (b *OptionsBuilder) DebugHeader(debug bool) *OptionsBuilder {
+	return b.With(DebugHeader(debug))
+}
+
+// MaxBufferSize sets the MaxBufferSize option.
+func (b *OptionsBuilder) MaxBufferSize(size int) *OptionsBuilder {
+	return b.With(MaxBufferSize(size))
+}
+
+// FlushInterval sets the FlushInterval option.
+func (b *OptionsBuilder) FlushInterval(d time.Duration) *OptionsBuilder {
+	return b.With(FlushInterval(d))
+}
+
+// FlushEvents sets the FlushEvents option.
+func (b *OptionsBuilder) FlushEvents(flush bool) *OptionsBuilder {
+	return b.With(FlushEvents(flush))
+}
+
+// FlushRecords sets the FlushRecords option.
+func (b *OptionsBuilder) FlushRecords(flush bool) *OptionsBuilder {
+	return b.With(FlushRecords(flush))
+}
+
+// FlushPolicies sets the FlushPolicies option.
+func (b *OptionsBuilder) FlushPolicies(policies map[string]FlushStrategy) *OptionsBuilder {
+	return b.With(FlushPolicies(policies))
+}
+
+// WriteThrough sets the WriteThrough option.
+func (b *OptionsBuilder) WriteThrough(fn func(c route.Context) bool) *OptionsBuilder {
+	return b.With(WriteThrough(fn))
+}
+
+// BodylessStatuses sets the BodylessStatuses option.
+func (b *OptionsBuilder) BodylessStatuses(codes ...int) *OptionsBuilder {
+	return b.With(BodylessStatuses(codes...))
+}
+
+// MinLength sets the MinLength option.
+func (b *OptionsBuilder) MinLength(length int) *OptionsBuilder {
+	return b.With(MinLength(length))
+}
+
+// ExcludedContentTypes sets the ExcludedContentTypes option.
+func (b *OptionsBuilder) ExcludedContentTypes(types ...string) *OptionsBuilder {
+	return b.With(ExcludedContentTypes(types...))
+}
+
+// Sniffer sets the Sniffer option.
+func (b *OptionsBuilder) Sniffer(fn func(c route.Context, data []byte) string) *OptionsBuilder {
+	return b.With(Sniffer(fn))
+}
+
+// SniffLength sets the SniffLength option.
+func (b *OptionsBuilder) SniffLength(length int) *OptionsBuilder {
+	return b.With(SniffLength(length))
+}
+
+// SkipAuthenticated sets the SkipAuthenticated option.
+func (b *OptionsBuilder) SkipAuthenticated(skip bool) *OptionsBuilder {
+	return b.With(SkipAuthenticated(skip))
+}
+
+// SkipSetCookie sets the SkipSetCookie option.
+func (b *OptionsBuilder) SkipSetCookie(skip bool) *OptionsBuilder {
+	return b.With(SkipSetCookie(skip))
+}
+
+// SkipCrossOrigin sets the SkipCrossOrigin option.
+func (b *OptionsBuilder) SkipCrossOrigin(skip bool) *OptionsBuilder {
+	return b.With(SkipCrossOrigin(skip))
+}
+
+// Sensitive sets the Sensitive option.
+func (b *OptionsBuilder) Sensitive(fn func(c route.Context) bool) *OptionsBuilder {
+	return b.With(Sensitive(fn))
+}
+
+// GzipPadding sets the GzipPadding option.
+func (b *OptionsBuilder) GzipPadding(max int) *OptionsBuilder {
+	return b.With(GzipPadding(max))
+}
+
+// LengthPadding sets the LengthPadding option.
+func (b *OptionsBuilder) LengthPadding(quantum int) *OptionsBuilder {
+	return b.With(LengthPadding(quantum))
+}
+
+// AbortOnError sets the AbortOnError option.
+func (b *OptionsBuilder) AbortOnError(abort bool) *OptionsBuilder {
+	return b.With(AbortOnError(abort))
+}
+
+// OnError sets the OnError option.
+func (b *OptionsBuilder) OnError(fn func(c route.Context, err error)) *OptionsBuilder {
+	return b.With(OnError(fn))
+}
+
+// ConditionalVary sets the ConditionalVary option.
+func (b *OptionsBuilder) ConditionalVary(conditional bool) *OptionsBuilder {
+	return b.With(ConditionalVary(conditional))
+}
+
+// Vary sets the Vary option.
+func (b *OptionsBuilder) Vary(strategy VaryStrategy) *OptionsBuilder {
+	return b.With(Vary(strategy))
+}
+
+// OnComplete sets the OnComplete option.
+func (b *OptionsBuilder) OnComplete(fn func(c route.Context, s Stats)) *OptionsBuilder {
+	return b.With(OnComplete(fn))
+}
+
+// OnSkip sets the OnSkip option.
+func (b *OptionsBuilder) OnSkip(fn func(c route.Context, reason SkipReason)) *OptionsBuilder {
+	return b.With(OnSkip(fn))
+}
+
+// AnomalyFactor sets the AnomalyFactor option.
+func (b *OptionsBuilder) AnomalyFactor(factor float64) *OptionsBuilder {
+	return b.With(AnomalyFactor(factor))
+}
+
+// OnAnomaly sets the OnAnomaly option.
+func (b *OptionsBuilder) OnAnomaly(fn func(c route.Context, s Stats, baseline float64)) *OptionsBuilder {
+	return b.With(OnAnomaly(fn))
+}
+
+// Logger sets the Logger option.
+func (b *OptionsBuilder) Logger(logger *slog.Logger) *OptionsBuilder {
+	return b.With(Logger(logger))
+}
+
+// Shadow sets the Shadow option.
+func (b *OptionsBuilder) Shadow(shadow bool) *OptionsBuilder {
+	return b.With(Shadow(shadow))
+}
+
+// ShadowRate sets the ShadowRate option.
+func (b *OptionsBuilder) ShadowRate(rate float64) *OptionsBuilder {
+	return b.With(ShadowRate(rate))
+}
+
+// NegotiationLogRate sets the NegotiationLogRate option.
+func (b *OptionsBuilder) NegotiationLogRate(rate float64) *OptionsBuilder {
+	return b.With(NegotiationLogRate(rate))
+}
+
+// Aliases sets the Aliases option.
+func (b *OptionsBuilder) Aliases(aliases map[string]Encoding) *OptionsBuilder {
+	return b.With(Aliases(aliases))
+}
+
+// Selector sets the Selector option.
+func (b *OptionsBuilder) Selector(selector func(c route.Context) (encoding string, level int, ok bool)) *OptionsBuilder {
+	return b.With(Selector(selector))
+}
+
+// Collect sets the Collector option.
+func (b *OptionsBuilder) Collect(collector *Collector) *OptionsBuilder {
+	return b.With(Collect(collector))
+}
+
+// Limit sets the Limiter option.
+func (b *OptionsBuilder) Limit(limiter *Limiter) *OptionsBuilder {
+	return b.With(Limit(limiter))
+}
+
+// LimitKey sets the LimitKey option.
+func (b *OptionsBuilder) LimitKey(fn func(c route.Context) string) *OptionsBuilder {
+	return b.With(LimitKey(fn))
+}
+
+// RolloutPercent sets the RolloutPercent option.
+func (b *OptionsBuilder) RolloutPercent(percent float64) *OptionsBuilder {
+	return b.With(RolloutPercent(percent))
+}
+
+// RolloutKey sets the RolloutKey option.
+func (b *OptionsBuilder) RolloutKey(fn func(c route.Context) string) *OptionsBuilder {
+	return b.With(RolloutKey(fn))
+}
+
+// Expvar sets the Expvar option.
+func (b *OptionsBuilder) Expvar(name string) *OptionsBuilder {
+	return b.With(Expvar(name))
+}
+
+// Disabled sets the Disabled option.
+func (b *OptionsBuilder) Disabled(disabled bool) *OptionsBuilder {
+	return b.With(Disabled(disabled))
+}
+
+// Edge sets the Edge option.
+func (b *OptionsBuilder) Edge(edge bool) *OptionsBuilder {
+	return b.With(Edge(edge))
+}
+
+// Transcode sets the Transcode option.
+func (b *OptionsBuilder) Transcode(transcode bool) *OptionsBuilder {
+	return b.With(Transcode(transcode))
+}
+
+// Provider sets the Provider option.
+func (b *OptionsBuilder) Provider(provider func(c route.Context) *Options) *OptionsBuilder {
+	return b.With(Provider(provider))
+}
+
+// PerHost sets the PerHost option.
+func (b *OptionsBuilder) PerHost(hosts map[string]Options) *OptionsBuilder {
+	return b.With(PerHost(hosts))
+}
@@ -0,0 +1,368 @@
+// Command compress-bench measures how the payloads of an application
+// compress, to tune the options of the compress middleware on real data
+// instead of guesses. It compresses every file under a directory of sample
+// payloads with each content coding and level, reports the size and time
+// taken for each, and recommends a Level, MinLength and ExcludedContentTypes.
+//
+// Usage:
+//
+//	compress-bench [flags] dir
+//
+// The recommendation is a JSON object of options, which compress-demo reads
+// with -config and ConfigHandler accepts as a PATCH:
+//
+//	compress-bench -out options.json ./samples
+//	compress-demo -config options.json
+//
+// Times are the wall time of compressing each payload in memory on one
+// goroutine, the best of -runs, which approximates the CPU time of a request.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goroute/compress"
+)
+
+// sample is a payload of the corpus.
+type sample struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// result is the outcome of compressing the corpus with one coding and level.
+type result struct {
+	encoding string
+	level    int
+	in, out  int64
+	took     time.Duration
+	// sizes holds the compressed size of each sample.
+	sizes []int
+}
+
+// ratio returns the compressed size as a fraction of the original size.
+func (r result) ratio() float64 {
+	if r.in == 0 {
+		return 1
+	}
+	return float64(r.out) / float64(r.in)
+}
+
+// throughput returns the input compressed per second, in MB.
+func (r result) throughput() float64 {
+	if r.took <= 0 {
+		return 0
+	}
+	return float64(r.in) / 1e6 / r.took.Seconds()
+}
+
+// recommendation holds the recommended options, in the JSON form of
+// compress.Options. ExcludedContentTypes is left out when empty, so that
+// applying it keeps the list of the options it applies to.
+type recommendation struct {
+	Level                int      `json:"level"`
+	MinLength            int      `json:"min_length"`
+	ExcludedContentTypes []string `json:"excluded_content_types,omitempty"`
+}
+
+func main() {
+	var (
+		encodings = flag.String("encodings", "gzip,deflate", "comma-separated content `codings` to measure")
+		levels    = flag.String("levels", "1,2,3,4,5,6,7,8,9", "comma-separated compression `levels` to measure")
+		runs      = flag.Int("runs", 3, "compress each payload `n` times and keep the best time")
+		tolerance = flag.Float64("tolerance", 0.02, "recommend the fastest level whose output is within this `fraction` of the smallest")
+		saving    = flag.Float64("min-saving", 0.1, "exclude content types, and payloads under MinLength, that save less than this `fraction`")
+		out       = flag.String("out", "", "write the recommended options to `file` instead of standard output")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: compress-bench [flags] dir\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *runs < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	lvls, err := parseLevels(*levels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	samples, err := load(os.DirFS(flag.Arg(0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(samples) == 0 {
+		log.Fatalf("no payloads in %s", flag.Arg(0))
+	}
+	results, err := bench(samples, strings.Split(*encodings, ","), lvls, *runs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report(os.Stderr, samples, results)
+
+	rec := recommend(samples, results, *tolerance, *saving)
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	b = append(b, '\n')
+	if *out != "" {
+		err = os.WriteFile(*out, b, 0o644)
+	} else {
+		_, err = os.Stdout.Write(b)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseLevels parses a comma-separated list of gzip levels.
+func parseLevels(s string) ([]int, error) {
+	var levels []int
+	for _, f := range strings.Split(s, ",") {
+		level, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid level %q", f)
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("%w: %d", compress.ErrInvalidLevel, level)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// load reads the regular files of fsys, with their content type guessed from
+// the extension, or else from the content.
+func load(fsys fs.FS) ([]sample, error) {
+	var samples []sample
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		contentType := mime.TypeByExtension(path.Ext(p))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+			contentType = mt
+		}
+		samples = append(samples, sample{name: p, contentType: contentType, data: data})
+		return nil
+	})
+	return samples, err
+}
+
+// bench compresses every sample with each encoding and level, runs times,
+// keeping the best time.
+func bench(samples []sample, encodings []string, levels []int, runs int) ([]result, error) {
+	var (
+		results []result
+		buf     bytes.Buffer
+	)
+	for _, encoding := range encodings {
+		encoding = strings.TrimSpace(encoding)
+		for _, level := range levels {
+			r := result{encoding: encoding, level: level, sizes: make([]int, len(samples))}
+			for i, s := range samples {
+				var best time.Duration
+				for run := 0; run < runs; run++ {
+					buf.Reset()
+					start := time.Now()
+					if err := encode(&buf, encoding, level, s.data); err != nil {
+						return nil, err
+					}
+					if took := time.Since(start); run == 0 || took < best {
+						best = took
+					}
+				}
+				r.in += int64(len(s.data))
+				r.out += int64(buf.Len())
+				r.took += best
+				r.sizes[i] = buf.Len()
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// encode writes data to w encoded with encoding at level.
+func encode(w io.Writer, encoding string, level int, data []byte) error {
+	cw, err := compress.NewWriter(encoding, w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := cw.Write(data); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// report writes a table of the results, and of how each content type
+// compresses with gzip at the default level, to w.
+func report(w io.Writer, samples []sample, results []result) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "encoding\tlevel\tin\tout\tratio\ttime\tMB/s\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.3f\t%s\t%.1f\t\n",
+			r.encoding, r.level, r.in, r.out, r.ratio(), r.took.Round(time.Microsecond), r.throughput())
+	}
+	tw.Flush()
+
+	if def, ok := find(results, string(compress.EncodingGzip), gzip.DefaultCompression); ok {
+		fmt.Fprintln(w)
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "content type\tfiles\tin\tout\tratio\t")
+		for _, t := range byType(samples, def) {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.3f\t\n", t.contentType, t.files, t.in, t.out, t.ratio())
+		}
+		tw.Flush()
+	}
+}
+
+// find returns the result of encoding at level, treating
+// gzip.DefaultCompression as the level it stands for.
+func find(results []result, encoding string, level int) (result, bool) {
+	if level == gzip.DefaultCompression {
+		level = 6
+	}
+	for _, r := range results {
+		l := r.level
+		if l == gzip.DefaultCompression {
+			l = 6
+		}
+		if r.encoding == encoding && l == level {
+			return r, true
+		}
+	}
+	return result{}, false
+}
+
+// typeResult is the outcome of compressing the samples of a content type.
+type typeResult struct {
+	contentType string
+	files       int
+	in, out     int64
+}
+
+func (t typeResult) ratio() float64 {
+	return float64(t.out) / float64(t.in)
+}
+
+// byType groups the sizes of r by content type, sorted by content type.
+func byType(samples []sample, r result) []typeResult {
+	m := make(map[string]*typeResult)
+	var types []typeResult
+	for i, s := range samples {
+		t := m[s.contentType]
+		if t == nil {
+			t = &typeResult{contentType: s.contentType}
+			m[s.contentType] = t
+		}
+		t.files++
+		t.in += int64(len(s.data))
+		t.out += int64(r.sizes[i])
+	}
+	for _, t := range m {
+		if t.in > 0 {
+			types = append(types, *t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].contentType < types[j].contentType })
+	return types
+}
+
+// largePayload is the size from which payloads tell how their content type
+// compresses, the gzip header and trailer aside.
+const largePayload = 1024
+
+// recommend returns the options that suit the corpus with gzip, the coding
+// the middleware produces:
+//   - Level is the fastest level measured whose output is within tolerance
+//     of the smallest output.
+//   - ExcludedContentTypes lists the content types whose payloads of at
+//     least largePayload bytes save less than saving at that level.
+//   - MinLength is one more than the size of the largest remaining payload
+//     that saves less than saving, or the default if there is none.
+func recommend(samples []sample, results []result, tolerance, saving float64) recommendation {
+	opts := compress.GetDefaultOptions()
+	rec := recommendation{Level: opts.Level, MinLength: opts.MinLength}
+	var gz []result
+	for _, r := range results {
+		if r.encoding == string(compress.EncodingGzip) {
+			gz = append(gz, r)
+		}
+	}
+	if len(gz) == 0 {
+		return rec
+	}
+	smallest := gz[0].out
+	for _, r := range gz {
+		if r.out < smallest {
+			smallest = r.out
+		}
+	}
+	var best result
+	for _, r := range gz {
+		if float64(r.out) > float64(smallest)*(1+tolerance) {
+			continue
+		}
+		if best.sizes == nil || r.took < best.took {
+			best = r
+		}
+	}
+	rec.Level = best.level
+
+	// Small payloads compress poorly whatever their type: the content types
+	// are judged on the larger ones.
+	var large []sample
+	largeResult := result{}
+	for i, s := range samples {
+		if len(s.data) >= largePayload {
+			large = append(large, s)
+			largeResult.sizes = append(largeResult.sizes, best.sizes[i])
+		}
+	}
+	excluded := make(map[string]bool)
+	for _, t := range byType(large, largeResult) {
+		if t.ratio() > 1-saving {
+			excluded[t.contentType] = true
+			rec.ExcludedContentTypes = append(rec.ExcludedContentTypes, t.contentType)
+		}
+	}
+	minLength := -1
+	for i, s := range samples {
+		if excluded[s.contentType] || len(s.data) == 0 {
+			continue
+		}
+		if float64(best.sizes[i]) > float64(len(s.data))*(1-saving) && len(s.data)+1 > minLength {
+			minLength = len(s.data) + 1
+		}
+	}
+	if minLength >= 0 {
+		rec.MinLength = minLength
+	}
+	return rec
+}
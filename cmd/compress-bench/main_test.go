@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/goroute/compress"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevels(t *testing.T) {
+	levels, err := parseLevels("1, 6,9")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 6, 9}, levels)
+	_, err = parseLevels("fast")
+	assert.Error(t, err)
+	_, err = parseLevels("10")
+	assert.True(t, errors.Is(err, compress.ErrInvalidLevel))
+}
+
+func TestBench(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	samples, err := load(fstest.MapFS{
+		"index.html":      {Data: []byte(strings.Repeat("<p>test</p>\n", 500))},
+		"api/list.json":   {Data: []byte(strings.Repeat(`{"id":1,"name":"test"},`, 200))},
+		"img/photo.jpg":   {Data: random},
+		"small/short.txt": {Data: []byte("test")},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	types := make(map[string]string)
+	for _, s := range samples {
+		types[s.name] = s.contentType
+	}
+	assert.Equal(t, map[string]string{
+		"index.html":      "text/html",
+		"api/list.json":   "application/json",
+		"img/photo.jpg":   "image/jpeg",
+		"small/short.txt": "text/plain",
+	}, types)
+
+	results, err := bench(samples, []string{"gzip", "deflate"}, []int{1, 9}, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, results, 4)
+	for _, r := range results {
+		assert.Len(t, r.sizes, len(samples))
+		assert.True(t, r.out < r.in, r.encoding)
+		assert.True(t, r.took > 0, r.encoding)
+	}
+	_, err = bench(samples, []string{"br"}, []int{1}, 1)
+	assert.True(t, errors.Is(err, compress.ErrUnsupportedEncoding))
+
+	rec := recommend(samples, results, 1, 0.1)
+	assert.Equal(t, []string{"image/jpeg"}, rec.ExcludedContentTypes)
+	assert.Equal(t, len("test")+1, rec.MinLength)
+
+	var buf bytes.Buffer
+	report(&buf, samples, results)
+	assert.Contains(t, buf.String(), "deflate")
+}
+
+func TestRecommend(t *testing.T) {
+	samples := []sample{
+		{contentType: "text/html", data: make([]byte, 2000)},
+		{contentType: "text/html", data: make([]byte, 100)},
+	}
+	results := []result{
+		{encoding: "gzip", level: 1, out: 1100, took: time.Millisecond, sizes: []int{1000, 100}},
+		{encoding: "gzip", level: 5, out: 1050, took: 2 * time.Millisecond, sizes: []int{960, 95}},
+		{encoding: "gzip", level: 9, out: 1000, took: 5 * time.Millisecond, sizes: []int{920, 80}},
+		{encoding: "deflate", level: 1, out: 900, took: time.Microsecond, sizes: []int{850, 50}},
+	}
+	// The fastest gzip level within 6% of the smallest output.
+	rec := recommend(samples, results, 0.06, 0.1)
+	assert.Equal(t, 5, rec.Level)
+	assert.Equal(t, 101, rec.MinLength)
+	assert.Empty(t, rec.ExcludedContentTypes)
+
+	rec = recommend(samples, results, 0.2, 0.1)
+	assert.Equal(t, 1, rec.Level)
+	rec = recommend(samples, results, 0, 0.1)
+	assert.Equal(t, 9, rec.Level)
+	assert.Equal(t, compress.GetDefaultOptions().MinLength, rec.MinLength)
+
+	// Without gzip results, the defaults.
+	rec = recommend(samples, results[3:], 0, 0.1)
+	assert.Equal(t, compress.GetDefaultOptions().Level, rec.Level)
+}
@@ -0,0 +1,292 @@
+// Command compress-demo is a reference server for the compress middleware.
+// It serves responses that exercise every option (thresholds, content types,
+// streaming, pre-encoded bodies, static files and their validators) with
+// options set from flags, so that a behavior can be reproduced against a
+// known configuration and attached to a bug report.
+//
+// Usage:
+//
+//	compress-demo [flags]
+//
+// The options start from a preset, then the JSON file of -config, then each
+// -set in order, then the shorthand flags:
+//
+//	compress-demo -preset production -set flush_interval=100ms -set 'digest=["sha-256"]' -level 9
+//
+// -set takes the JSON name of an option and a JSON value; durations may also
+// be written like "100ms", and other values that are not valid JSON are taken
+// as strings. -print writes the resulting options as
+// JSON and exits: include its output in bug reports.
+//
+// Endpoints:
+//
+//	GET  /text?size=N&type=T          N bytes of text, of Content-Type T
+//	GET  /json?n=N                    a JSON array of N records, streamed
+//	GET  /events?n=N&interval=D       N server-sent events, D apart
+//	GET  /encoded?encoding=E&size=N   N bytes of text encoded with E upstream
+//	GET  /static/*                    the files of -dir
+//	GET  /archive                     a ZIP archive of -dir
+//	GET  /stats                       the counters of the middleware
+//	GET  /config, PATCH /config       the options, tunable at runtime
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goroute/compress"
+	"github.com/goroute/route"
+)
+
+// settings is a repeatable flag of name=value pairs.
+type settings []string
+
+func (s *settings) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *settings) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("want name=value")
+	}
+	*s = append(*s, value)
+	return nil
+}
+
+func main() {
+	var (
+		addr      = flag.String("addr", "localhost:8080", "address to listen on")
+		preset    = flag.String("preset", "default", "options to start from: default, development or production")
+		config    = flag.String("config", "", "JSON `file` of options, applied over the preset")
+		level     = flag.Int("level", 0, "compression level, if not 0")
+		minLength = flag.Int("min-length", -1, "MinLength, if not negative")
+		dir       = flag.String("dir", ".", "`directory` served under /static and /archive")
+		printOpts = flag.Bool("print", false, "print the options as JSON and exit")
+		set       settings
+	)
+	flag.Var(&set, "set", "set the option `name=value`, with the JSON name and value of the option; repeatable")
+	flag.Parse()
+
+	opts, err := options(*preset, *config, set)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *level != 0 {
+		opts.Level = *level
+	}
+	if *minLength >= 0 {
+		opts.MinLength = *minLength
+	}
+	if *printOpts {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	mux, err := newServer(opts, *dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// options returns the options of preset, overridden by the JSON file config,
+// if not empty, and by the name=value pairs of set.
+func options(preset, config string, set []string) (compress.Options, error) {
+	var opts compress.Options
+	switch preset {
+	case "default":
+		opts = compress.GetDefaultOptions()
+	case "development":
+		opts = compress.Development()
+	case "production":
+		opts = compress.Production()
+	default:
+		return opts, fmt.Errorf("unknown preset %q", preset)
+	}
+	if config != "" {
+		b, err := os.ReadFile(config)
+		if err != nil {
+			return opts, err
+		}
+		if err := json.Unmarshal(b, &opts); err != nil {
+			return opts, fmt.Errorf("%s: %w", config, err)
+		}
+	}
+	for _, s := range set {
+		name, value, _ := strings.Cut(s, "=")
+		raw := json.RawMessage(value)
+		if !json.Valid(raw) {
+			if d, err := time.ParseDuration(value); err == nil {
+				raw, _ = json.Marshal(d)
+			} else {
+				raw, _ = json.Marshal(value)
+			}
+		}
+		patch, _ := json.Marshal(map[string]json.RawMessage{name: raw})
+		if err := json.Unmarshal(patch, &opts); err != nil {
+			return opts, fmt.Errorf("-set %s: %w", s, err)
+		}
+	}
+	return opts, nil
+}
+
+// newServer returns the demo routes behind the middleware configured by
+// opts, serving the files of dir.
+func newServer(opts compress.Options, dir string) (*route.Mux, error) {
+	// The endpoints about the middleware are not compressed, so that they
+	// read the same whatever the options.
+	if opts.Collector == nil {
+		opts.Collector = compress.NewCollector()
+	}
+	skipper := opts.Skipper
+	opts.Skipper = func(c route.Context) bool {
+		switch c.Path() {
+		case "/stats", "/config":
+			return true
+		}
+		return skipper != nil && skipper(c)
+	}
+	config, err := compress.NewConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	mux := route.NewServeMux()
+	mux.Use(config.Middleware())
+
+	mux.GET("/text", text)
+	mux.GET("/json", records)
+	mux.GET("/events", events)
+	mux.GET("/encoded", encoded)
+	mux.Static("/static", dir)
+	mux.GET("/archive", compress.Zip(os.DirFS(dir), "."))
+	mux.GET("/stats", compress.StatsHandler(opts.Collector))
+	mux.GET("/config", compress.ConfigHandler(config))
+	mux.PATCH("/config", compress.ConfigHandler(config))
+	return mux, nil
+}
+
+// text replies with size bytes of text, 4 KiB by default, of the Content-Type
+// type, text/plain by default.
+func text(c route.Context) error {
+	size, err := intParam(c, "size", 4096)
+	if err != nil {
+		return err
+	}
+	contentType := c.QueryParam("type")
+	if contentType == "" {
+		contentType = route.MIMETextPlainCharsetUTF8
+	}
+	c.Response().Header().Set(route.HeaderContentType, contentType)
+	return c.Blob(http.StatusOK, contentType, sample(size))
+}
+
+// record is an element of the array sent by records.
+type record struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// records streams a JSON array of n records, 100 by default.
+func records(c route.Context) error {
+	n, err := intParam(c, "n", 100)
+	if err != nil {
+		return err
+	}
+	list := make([]record, n)
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range list {
+		list[i] = record{ID: i, Name: "record " + strconv.Itoa(i), Created: created.Add(time.Duration(i) * time.Minute)}
+	}
+	return compress.JSON(c, http.StatusOK, list)
+}
+
+// events sends n server-sent events, 10 by default, interval apart, 1s by
+// default, to observe the flushing options.
+func events(c route.Context) error {
+	n, err := intParam(c, "n", 10)
+	if err != nil {
+		return err
+	}
+	interval := time.Second
+	if v := c.QueryParam("interval"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			return route.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	h := c.Response().Header()
+	h.Set(route.HeaderContentType, "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-c.Request().Context().Done():
+				return nil
+			}
+		}
+		if _, err := fmt.Fprintf(c.Response(), "id: %d\ndata: event %d\n\n", i, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encoded replies with size bytes of text, 4 KiB by default, encoded with
+// the content coding encoding, gzip by default, as an upstream that
+// compresses its responses would, to observe pass-through and Transcode.
+func encoded(c route.Context) error {
+	size, err := intParam(c, "size", 4096)
+	if err != nil {
+		return err
+	}
+	encoding := c.QueryParam("encoding")
+	if encoding == "" {
+		encoding = string(compress.EncodingGzip)
+	}
+	var buf bytes.Buffer
+	w, err := compress.NewWriter(encoding, &buf, compress.GetDefaultOptions().Level)
+	if err != nil {
+		return route.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	w.Write(sample(size))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.Response().Header().Set(route.HeaderContentEncoding, encoding)
+	return c.Blob(http.StatusOK, route.MIMETextPlainCharsetUTF8, buf.Bytes())
+}
+
+// sample returns size bytes of text.
+func sample(size int) []byte {
+	const line = "The quick brown fox jumps over the lazy dog.\n"
+	return bytes.Repeat([]byte(line), size/len(line)+1)[:size]
+}
+
+// intParam returns the query parameter name as a non-negative integer, or def
+// if it is not set.
+func intParam(c route.Context, name string, def int) (int, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, route.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid %s %q", name, v))
+	}
+	return n, nil
+}
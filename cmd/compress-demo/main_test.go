@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goroute/compress"
+	"github.com/goroute/compress/compresstest"
+	"github.com/goroute/route"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptions(t *testing.T) {
+	opts, err := options("production", "", []string{
+		"level=9",
+		"flush_interval=100ms",
+		`digest=["sha-256"]`,
+		"etag=suffix",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 9, opts.Level)
+		assert.Equal(t, 100*time.Millisecond, opts.FlushInterval)
+		assert.Equal(t, []string{"sha-256"}, opts.Digest)
+		assert.Equal(t, compress.ETagSuffix, opts.ETag)
+		assert.Equal(t, compress.Production().MinLength, opts.MinLength)
+	}
+
+	_, err = options("fastest", "", nil)
+	assert.Error(t, err)
+	_, err = options("default", "", []string{"level=fast"})
+	assert.Error(t, err)
+}
+
+func TestServer(t *testing.T) {
+	mux, err := newServer(compress.GetDefaultOptions(), ".")
+	if !assert.NoError(t, err) {
+		return
+	}
+	get := func(target string) *compresstest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(compress.EncodingGzip))
+		rec := compresstest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/text?size=5000")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, string(compress.EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	assert.Len(t, rec.DecodedString(), 5000)
+
+	rec = get("/json?n=3")
+	var list []record
+	assert.NoError(t, json.Unmarshal([]byte(rec.DecodedString()), &list))
+	assert.Len(t, list, 3)
+
+	rec = get("/events?n=3&interval=1ms")
+	assert.Equal(t, 3, strings.Count(rec.DecodedString(), "data: "))
+
+	rec = get("/encoded?encoding=deflate&size=100")
+	assert.Equal(t, string(compress.EncodingDeflate), rec.Header().Get(route.HeaderContentEncoding))
+	assert.Len(t, rec.DecodedString(), 100)
+	assert.Equal(t, http.StatusBadRequest, get("/encoded?encoding=br").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/text?size=-1").Code)
+
+	rec = get("/static/main.go")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.DecodedString(), "package main")
+	assert.Equal(t, "application/zip", get("/archive").Header().Get(route.HeaderContentType))
+
+	// The endpoints about the middleware are not compressed.
+	rec = get("/stats")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+	var counters compress.Counters
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &counters))
+	assert.True(t, counters.Compressed > 0)
+
+	req := httptest.NewRequest(http.MethodPatch, "/config", strings.NewReader(`{"disabled": true}`))
+	rec = compresstest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, get("/text").Header().Get(route.HeaderContentEncoding))
+}
@@ -0,0 +1,241 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/goroute/route"
+)
+
+// Codec implements a content coding for NewReader and NewWriter, besides the
+// built-in ones, for example a fake coding in tests.
+type Codec struct {
+	// NewReader returns a reader decoding r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+
+	// NewWriter returns a writer encoding to w at the compression level
+	// level. If the writer has a Flush() error method, NewWriter uses it.
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+}
+
+var codecs struct {
+	sync.RWMutex
+	m map[Encoding]Codec
+}
+
+// RegisterCodec registers codec for the content coding encoding, replacing
+// the codec registered before. It panics for the built-in codings gzip,
+// x-gzip, deflate and identity.
+func RegisterCodec(encoding Encoding, codec Codec) {
+	encoding = Encoding(strings.ToLower(string(encoding)))
+	if builtinCoding(encoding) {
+		panic(fmt.Sprintf("compress: %q is a built-in coding", encoding))
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	if codecs.m == nil {
+		codecs.m = make(map[Encoding]Codec)
+	}
+	codecs.m[encoding] = codec
+}
+
+// UnregisterCodec removes the codec registered for encoding, if any.
+func UnregisterCodec(encoding Encoding) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	delete(codecs.m, Encoding(strings.ToLower(string(encoding))))
+}
+
+// registeredCodec returns the codec registered for encoding.
+func registeredCodec(encoding Encoding) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, ok := codecs.m[encoding]
+	return codec, ok
+}
+
+// knownCoding reports whether encoding is one of the Encoding constants or
+// a coding registered with RegisterCodec.
+func knownCoding(encoding Encoding) bool {
+	switch encoding {
+	case EncodingGzip, EncodingDeflate, EncodingBrotli, EncodingZstd, EncodingIdentity:
+		return true
+	}
+	_, ok := registeredCodec(encoding)
+	return ok
+}
+
+func builtinCoding(encoding Encoding) bool {
+	switch encoding {
+	case EncodingGzip, "x-gzip", EncodingDeflate, EncodingIdentity, "":
+		return true
+	}
+	return false
+}
+
+// NewReader returns a reader decoding r, encoded with the content coding
+// encoding: gzip (or x-gzip), deflate, identity and "" for no coding, or a
+// coding registered with RegisterCodec. deflate reads both zlib streams and
+// raw DEFLATE, which some servers send. Closing the reader does not close r.
+// The error wraps ErrUnsupportedEncoding for other codings, or is the error
+// reading the header of r.
+func NewReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	coding := Encoding(strings.ToLower(strings.TrimSpace(encoding)))
+	switch coding {
+	case EncodingGzip, "x-gzip":
+		return gzip.NewReader(r)
+	case EncodingDeflate:
+		return newDeflateReader(r)
+	case EncodingIdentity, "":
+		return io.NopCloser(r), nil
+	}
+	if codec, ok := registeredCodec(coding); ok && codec.NewReader != nil {
+		return codec.NewReader(r)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, encoding)
+}
+
+// NewWriter returns a writer encoding what is written to it to w with the
+// content coding encoding, at the compression level level, one of the
+// gzip levels: gzip (or x-gzip), deflate as a zlib stream, identity and ""
+// for no coding, or a coding registered with RegisterCodec. Close flushes
+// the encoded data and writes the trailer, without closing w. Every writer also has a Flush() error method that
+// writes out the data encoded so far, so that the receiver can decode it,
+// and flushes w if it has a Flush method, as an http.ResponseWriter does:
+// streams behave the same whatever the coding. The error wraps
+// ErrUnsupportedEncoding for other codings, or ErrInvalidLevel.
+func NewWriter(encoding string, w io.Writer, level int) (io.WriteCloser, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidLevel, level)
+	}
+	var (
+		enc encoder
+		err error
+	)
+	coding := Encoding(strings.ToLower(strings.TrimSpace(encoding)))
+	switch coding {
+	case EncodingGzip, "x-gzip":
+		enc, err = gzip.NewWriterLevel(w, level)
+	case EncodingDeflate:
+		enc, err = zlib.NewWriterLevel(w, level)
+	case EncodingIdentity, "":
+		enc = nopEncoder{w}
+	default:
+		codec, ok := registeredCodec(coding)
+		if !ok || codec.NewWriter == nil {
+			return nil, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, encoding)
+		}
+		var cw io.WriteCloser
+		if cw, err = codec.NewWriter(w, level); err == nil {
+			if e, ok := cw.(encoder); ok {
+				enc = e
+			} else {
+				enc = flushlessEncoder{cw}
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &codecWriter{encoder: enc, w: w}, nil
+}
+
+// DecodeBody reads and closes the body of res, and returns it decoded,
+// undoing the content codings of the response in the reverse order of
+// Content-Encoding, with NewReader. A body that http.Transport or Transport
+// decoded already, with Uncompressed set, is returned as read. The error
+// wraps ErrUnsupportedEncoding for a coding NewReader cannot decode, or is
+// the error reading or decoding the body.
+func DecodeBody(res *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || res.Uncompressed {
+		return body, err
+	}
+	var codings []string
+	for _, v := range res.Header.Values(route.HeaderContentEncoding) {
+		for _, coding := range strings.Split(v, ",") {
+			if coding = strings.TrimSpace(coding); coding != "" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	for i := len(codings) - 1; i >= 0; i-- {
+		r, err := NewReader(codings[i], bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// newDeflateReader decodes the deflate coding, which RFC 9110 defines as a
+// zlib stream but some servers send as raw DEFLATE.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// encoder is implemented by the writers of the codecs.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// codecWriter is the writer returned by NewWriter. Flush flushes the encoder,
+// then w.
+type codecWriter struct {
+	encoder
+	w io.Writer
+}
+
+func (cw *codecWriter) Flush() error {
+	if err := cw.encoder.Flush(); err != nil {
+		return err
+	}
+	switch f := cw.w.(type) {
+	case interface{ FlushError() error }:
+		return f.FlushError()
+	case interface{ Flush() error }:
+		return f.Flush()
+	case http.Flusher:
+		f.Flush()
+	}
+	return nil
+}
+
+// flushlessEncoder adapts the writer of a registered codec without Flush.
+type flushlessEncoder struct {
+	io.WriteCloser
+}
+
+func (flushlessEncoder) Flush() error {
+	return nil
+}
+
+// nopEncoder is the encoder of the identity coding.
+type nopEncoder struct {
+	io.Writer
+}
+
+func (nopEncoder) Close() error {
+	return nil
+}
+
+func (nopEncoder) Flush() error {
+	return nil
+}
@@ -1,13 +1,20 @@
 package compress
 
 import (
-	"bufio"
+	"bytes"
 	"compress/gzip"
-	"io"
-	"io/ioutil"
-	"net"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/goroute/route"
 )
@@ -15,30 +22,676 @@ import (
 // Options defines the config for Gzip middleware.
 type Options struct {
 	// Skipper defines a function to skip middleware.
-	Skipper route.Skipper
+	Skipper route.Skipper `yaml:"-" json:"-"`
 
 	// Gzip compression level.
 	// Optional. Default value -1.
-	Level int `yaml:"level"`
+	Level int `yaml:"level" json:"level"`
+
+	// ETag defines how a strong ETag set by the handler is adjusted when the
+	// response is compressed.
+	// Optional. Default value ETagWeaken.
+	ETag ETagStrategy `yaml:"etag" json:"etag"`
+
+	// ComputeETag replaces the ETag of 200 OK responses with a strong
+	// validator computed over the compressed body. The response is held in
+	// memory until the handler returns, so If-None-Match can be answered with
+	// 304 Not Modified. Responses that exceed MaxBufferSize or are flushed by
+	// the handler are streamed without a computed ETag. It cannot be combined
+	// with GzipPadding, which makes every compressed body differ.
+	// Optional. Default value false.
+	ComputeETag bool `yaml:"compute_etag" json:"compute_etag"`
+
+	// Buffer holds the compressed body of 200 OK responses in memory until the
+	// handler returns and sends it with an explicit Content-Length instead of
+	// chunked transfer encoding. Responses that exceed MaxBufferSize or are
+	// flushed by the handler are streamed as usual.
+	// Optional. Default value false.
+	Buffer bool `yaml:"buffer" json:"buffer"`
+
+	// Digest lists the algorithms ("sha-256", "sha-512") used to emit
+	// Content-Digest and Repr-Digest (RFC 9530) headers on buffered 200 OK
+	// responses. Both cover the gzip-encoded bytes: the content coding is part
+	// of the representation, so the digests let clients verify the payload
+	// exactly as received. Setting it buffers responses like Buffer does.
+	// Optional. Default value nil.
+	Digest []string `yaml:"digest" json:"digest"`
+
+	// UncompressedLengthHeader names a header, such as
+	// "X-Uncompressed-Content-Length", that carries the number of bytes the
+	// handler wrote before compression. It is set on buffered responses and on
+	// streamed responses whose handler declared a Content-Length; other
+	// streamed responses send their headers before the length is known.
+	// Optional. Default value "".
+	UncompressedLengthHeader string `yaml:"uncompressed_length_header" json:"uncompressed_length_header"`
+
+	// HTTP2Buffer buffers compressed responses to HTTP/2 requests as if Buffer
+	// were set, so they carry a Content-Length. HTTP/2 frames the body itself
+	// and has no chunked encoding to fall back to, while an explicit length
+	// still helps clients and proxies plan the transfer. Buffering holds the
+	// whole response, up to MaxBufferSize, before sending any of it, which
+	// delays streamed responses.
+	// Optional. Default value false.
+	HTTP2Buffer bool `yaml:"http2_buffer" json:"http2_buffer"`
+
+	// StatsTrailers sends the uncompressed length and the compression ratio
+	// (compressed/uncompressed) of each compressed response in the
+	// X-Original-Length and X-Compression-Ratio trailers, so that proxies can
+	// collect them without buffering. Buffered responses carry them as
+	// headers instead.
+	// Optional. Default value false.
+	StatsTrailers bool `yaml:"stats_trailers" json:"stats_trailers"`
+
+	// DebugHeader adds an X-Compress header describing how the response was
+	// handled, such as "gzip;level=5;ratio=0.21;dur=1.8ms", or
+	// "identity;reason=not_accepted" when it was not compressed. Streamed
+	// responses carry it as a trailer. It is meant for debugging and
+	// reveals sizes, so leave it off where that matters.
+	// Optional. Default value false.
+	DebugHeader bool `yaml:"debug_header" json:"debug_header"`
+
+	// MaxBufferSize limits the number of compressed bytes held in memory for
+	// a buffered response.
+	// Optional. Default value 1MB.
+	MaxBufferSize int `yaml:"max_buffer_size" json:"max_buffer_size"`
+
+	// FlushInterval flushes a streaming response at most this long after
+	// the handler writes to it, so that server-sent events and long polls
+	// reach the client without the handler calling Flush. Any flush in the
+	// meantime makes the timed one unnecessary. Writes wait for a flush
+	// blocked on a slow client, and the next timed flush waits at least as
+	// long as that flush took, so slow clients never queue up flushes or
+	// buffered data. A response held back by Buffer is not flushed on time
+	// until it is released. Zero disables timed flushes.
+	// Optional. Default value 0.
+	FlushInterval time.Duration `yaml:"flush_interval" json:"flush_interval"`
+
+	// FlushEvents flushes compressed text/event-stream responses at the end
+	// of each event, the blank line that ends it, so that server-sent events
+	// reach the client one by one instead of once the compressor fills up.
+	// Optional. Default value true.
+	FlushEvents bool `yaml:"flush_events" json:"flush_events"`
+
+	// FlushRecords flushes compressed application/x-ndjson and
+	// application/jsonl responses after each newline-terminated record, so
+	// that consumers of streaming endpoints see records as they are written.
+	// Optional. Default value false.
+	FlushRecords bool `yaml:"flush_records" json:"flush_records"`
+
+	// FlushPolicies maps media types, such as "text/event-stream", or
+	// wildcards, such as "text/*", to the FlushStrategy of compressed
+	// responses of that type, so that one instance serves both pages best
+	// compressed whole and latency-sensitive streams. Other types get
+	// FlushDefault.
+	// Optional. Default value nil.
+	FlushPolicies map[string]FlushStrategy `yaml:"flush_policies" json:"flush_policies"`
+
+	// WriteThrough reports whether the compressed response to a request is
+	// flushed after every write of the handler, for endpoints where each
+	// write is a complete message. Latency wins over ratio: small writes
+	// compress poorly. Handlers can also opt in with MarkWriteThrough. It
+	// takes precedence over FlushPolicies.
+	// Optional. Default value nil.
+	WriteThrough func(c route.Context) bool `yaml:"-" json:"-"`
+
+	// MinLength is the body length below which responses are sent
+	// uncompressed, since the gzip framing would outweigh the savings. The
+	// handler's Content-Length is used when set; otherwise up to MinLength
+	// bytes are held back until the decision can be made.
+	// Optional. Default value 0.
+	MinLength int `yaml:"min_length" json:"min_length"`
+
+	// ExcludedContentTypes lists media types that are sent uncompressed,
+	// typically formats that are compressed already. An entry ending in "/"
+	// or "/*", such as "image/*", matches a whole top-level type.
+	// Optional. Default value nil.
+	ExcludedContentTypes []string `yaml:"excluded_content_types" json:"excluded_content_types"`
+
+	// Sniffer returns the Content-Type of a response whose handler set none,
+	// from its request and the first bytes of the body, or "" to fall back
+	// to http.DetectContentType. SniffExtension looks the type up by the
+	// extension of the request path.
+	// Optional. Default value nil.
+	Sniffer func(c route.Context, data []byte) string `yaml:"-" json:"-"`
+
+	// SniffLength is the number of body bytes held back and examined to
+	// detect the Content-Type of a response whose handler set none, and so
+	// whether ExcludedContentTypes applies. 0 examines the first write
+	// only.
+	// Optional. Default value 512.
+	SniffLength int `yaml:"sniff_length" json:"sniff_length"`
+
+	// SkipAuthenticated sends responses to requests carrying a Cookie or
+	// Authorization header uncompressed. Compressing secrets together with
+	// attacker-controlled input lets an attacker recover them from the
+	// compressed length (BREACH).
+	// Optional. Default value false.
+	SkipAuthenticated bool `yaml:"skip_authenticated" json:"skip_authenticated"`
+
+	// SkipSetCookie sends responses that set cookies uncompressed, as they
+	// often carry session secrets next to attacker-influenced content.
+	// Optional. Default value false.
+	SkipSetCookie bool `yaml:"skip_set_cookie" json:"skip_set_cookie"`
+
+	// SkipCrossOrigin sends responses to cross-origin requests carrying a
+	// Cookie or Authorization header uncompressed. BREACH needs the victim's
+	// browser to send credentialed requests on the attacker's behalf, so this
+	// keeps same-origin traffic compressed. Requests are told apart by
+	// Sec-Fetch-Site, or by comparing Origin with the request's own origin.
+	// Optional. Default value false.
+	SkipCrossOrigin bool `yaml:"skip_cross_origin" json:"skip_cross_origin"`
+
+	// Sensitive reports whether the response to a request may mix secrets
+	// with attacker-controlled input, in which case it is sent uncompressed.
+	// Optional. Default value nil.
+	Sensitive func(c route.Context) bool `yaml:"-" json:"-"`
+
+	// GzipPadding inserts a random filler of 1 to GzipPadding bytes into the
+	// file name field of each gzip header, the Heal-the-BREACH mitigation:
+	// the compressed length then varies from one response to the next, so
+	// it no longer reveals how well attacker input matched a secret.
+	// Optional. Default value 0.
+	GzipPadding int `yaml:"gzip_padding" json:"gzip_padding"`
+
+	// LengthPadding hides the exact length of compressed responses: an
+	// X-Padding header, or trailer for streamed responses, is added whose
+	// value brings the compressed body and padding up to the next multiple
+	// of LengthPadding bytes.
+	// Optional. Default value 0.
+	LengthPadding int `yaml:"length_padding" json:"length_padding"`
+
+	// BodylessStatuses lists the final status codes whose responses carry no
+	// body. They are sent without Content-Encoding, Content-Type or
+	// Content-Length and never get a compressor. 1xx responses are always
+	// treated this way.
+	// Optional. Default value [204, 304].
+	BodylessStatuses []int `yaml:"bodyless_statuses" json:"bodyless_statuses"`
+
+	// AbortOnError truncates a compressed response that is already being
+	// streamed when the handler returns an error: the gzip trailer is left
+	// out, so clients see an incomplete body instead of a valid but partial
+	// one. By default the stream is closed cleanly. Either way the response
+	// stays committed and route's error handler does not write into it.
+	// A buffered response that has not been sent yet is always dropped,
+	// along with the headers the handler set, so that the error handler can
+	// reply instead.
+	// Optional. Default value false.
+	AbortOnError bool `yaml:"abort_on_error" json:"abort_on_error"`
+
+	// OnError is called with the first error hit while compressing or sending
+	// a response, such as a failed flush or a gzip stream that could not be
+	// closed, as an *Error. The error is also returned by the middleware
+	// unless the handler returned one of its own.
+	// Optional. Default value nil.
+	OnError func(c route.Context, err error) `yaml:"-" json:"-"`
+
+	// ConditionalVary adds Vary: Accept-Encoding only to responses the
+	// middleware could compress: those not skipped whose status allows a
+	// body. By default every response that is not skipped gets it.
+	// Optional. Default value false.
+	ConditionalVary bool `yaml:"conditional_vary" json:"conditional_vary"`
+
+	// Vary defines how Accept-Encoding is added to the Vary header set by
+	// the handler or other middleware.
+	// Optional. Default value VaryMerge.
+	Vary VaryStrategy `yaml:"vary" json:"vary"`
+
+	// OnComplete is called with the Stats of each response once it has
+	// been completed, for feeding logging or metrics pipelines. It is not
+	// called for a buffered response dropped because the handler returned
+	// an error.
+	// Optional. Default value nil.
+	OnComplete func(c route.Context, s Stats) `yaml:"-" json:"-"`
+
+	// OnSkip is called with the reason whenever a response is not
+	// compressed, which helps finding misconfigured routes.
+	// Optional. Default value nil.
+	OnSkip func(c route.Context, reason SkipReason) `yaml:"-" json:"-"`
+
+	// AnomalyFactor turns on the detection of compressed responses whose
+	// ratio differs from the recent average for the same route by more than
+	// this factor, either way, which may point at data exfiltration or
+	// corrupted content. Anomalies are logged to Logger at level Warn,
+	// counted by the Collector and passed to OnAnomaly. A route is only
+	// checked once it has served 20 compressed responses.
+	// Optional. Default value 0.
+	AnomalyFactor float64 `yaml:"anomaly_factor" json:"anomaly_factor"`
+
+	// OnAnomaly is called with the Stats of an anomalous response and the
+	// average ratio of its route.
+	// Optional. Default value nil.
+	OnAnomaly func(c route.Context, s Stats, baseline float64) `yaml:"-" json:"-"`
+
+	// Logger receives the events of the middleware: errors at level Error,
+	// or Debug when caused by the client, buffered responses dropped
+	// because the handler failed at level Info and skipped responses at
+	// level Debug.
+	// Optional. Default value nil.
+	Logger *slog.Logger `yaml:"-" json:"-"`
+
+	// NegotiationLogRate is the fraction of requests, between 0 and 1, for
+	// which the raw Accept-Encoding header, its parsed codings and the
+	// chosen coding are logged to Logger at level Debug.
+	// Optional. Default value 0.
+	NegotiationLogRate float64 `yaml:"negotiation_log_rate" json:"negotiation_log_rate"`
+
+	// Aliases maps nonstandard content codings sent in Accept-Encoding by
+	// clients, such as "gzip-custom", to the Encoding they stand for. Keys
+	// are matched case-insensitively. "x-gzip" is always read as gzip.
+	// Values must be one of the Encoding constants or a coding registered
+	// with RegisterCodec.
+	// Optional. Default value nil.
+	Aliases map[string]Encoding `yaml:"aliases" json:"aliases"`
+
+	// Selector is consulted before negotiation, for example by a
+	// feature-flag system steering users or experiments onto other
+	// settings. If ok is false, the request is handled as usual. Otherwise
+	// level, if not 0, replaces Level for the request, and encoding picks
+	// the coding: gzip, or "" to keep the negotiated one, compresses with
+	// gzip if the client accepts it; identity sends the response
+	// uncompressed, skipped as selected. Other codings, which the
+	// middleware does not produce, fall back to negotiation. An invalid
+	// level fails the request with ErrInvalidLevel.
+	// Optional. Default value nil.
+	Selector func(c route.Context) (encoding string, level int, ok bool) `yaml:"-" json:"-"`
+
+	// Shadow turns on a dry-run mode for evaluating compression: responses
+	// are never altered, but those to clients that accept gzip are
+	// compressed into io.Discard. Their Stats, as seen by the Collector,
+	// OnComplete and the context keys, describe what compression would have
+	// done and have Shadow set.
+	// Optional. Default value false.
+	Shadow bool `yaml:"shadow" json:"shadow"`
+
+	// ShadowRate is the fraction of responses, between 0 and 1, that are
+	// measured in shadow mode. The others are skipped as not sampled.
+	// Optional. Default value 1.
+	ShadowRate float64 `yaml:"shadow_rate" json:"shadow_rate"`
+
+	// Collector aggregates the statistics of every response that goes
+	// through the middleware.
+	// Optional. Default value nil.
+	Collector *Collector `yaml:"-" json:"-"`
+
+	// Limiter limits the number of bytes compressed per client. Responses
+	// to clients over budget are sent uncompressed.
+	// Optional. Default value nil.
+	Limiter *Limiter `yaml:"-" json:"-"`
+
+	// LimitKey returns the key clients are told apart by in the Limiter.
+	// Optional. Default value the host of the remote address.
+	LimitKey func(c route.Context) string `yaml:"-" json:"-"`
+
+	// RolloutPercent is the percentage, between 0 and 100, of clients
+	// accepting gzip whose responses are compressed, to roll compression
+	// out gradually and compare metrics. A client is in or out according to
+	// a hash of its RolloutKey, so it gets the same treatment from one
+	// request to the next, and the clients in at a percentage stay in at a
+	// higher one. The responses of the others are skipped as not sampled
+	// and counted as such, unlike with Disabled: 0 starts a rollout with no
+	// client in.
+	// Optional. Default value 100.
+	RolloutPercent float64 `yaml:"rollout_percent" json:"rollout_percent"`
+
+	// RolloutKey returns the key clients are told apart by for
+	// RolloutPercent, for example a user or session ID.
+	// Optional. Default value the host of the remote address.
+	RolloutKey func(c route.Context) string `yaml:"-" json:"-"`
+
+	// Expvar publishes the counters of the Collector as an expvar variable
+	// of this name. A Collector is created if none is set. New panics if
+	// the name is already in use.
+	// Optional. Default value "".
+	Expvar string `yaml:"expvar" json:"expvar"`
+
+	// Disabled passes every response through untouched, without Vary or
+	// statistics, for example to switch compression off at runtime with
+	// Config.
+	// Optional. Default value false.
+	Disabled bool `yaml:"disabled" json:"disabled"`
+
+	// Edge removes Accept-Encoding from the request once it has been read,
+	// so that handlers proxying to upstream servers get uncompressed
+	// responses and compression happens only here, under one policy.
+	// Optional. Default value false.
+	Edge bool `yaml:"edge" json:"edge"`
+
+	// Transcode decodes responses the handler, such as a reverse proxy,
+	// sends encoded with gzip or deflate when the client does not accept
+	// that coding. The body is then compressed again with gzip if the
+	// client accepts it, or sent as is. Decoding streams the body, holding
+	// no more than the written chunk and the decompressor window.
+	// Optional. Default value false.
+	Transcode bool `yaml:"transcode" json:"transcode"`
+
+	// Provider returns the options for the request of c, for example those
+	// of the tenant it belongs to, or nil to use these options. Middleware
+	// is built once per pointer returned and kept for later requests, so
+	// return the same pointer for the same settings: once 1024 pointers have
+	// been seen, requests with a new one fail with ErrInvalidOption. The
+	// Provider field of the returned options is ignored. If they are
+	// invalid, the request fails with the error of Options.Validate.
+	// Optional. Default value nil.
+	Provider func(c route.Context) *Options `yaml:"-" json:"-"`
+
+	// PerHost maps hosts to the options of the requests they receive, for
+	// servers terminating several virtual hosts on one mux. Hosts match the
+	// Host header of the request without its port, case-insensitively; a
+	// key "*.example.com" matches the subdomains of example.com that have no
+	// entry of their own. Requests to other hosts use these options.
+	// Entries decoded from JSON or YAML start from GetDefaultOptions, like
+	// HostOptions describes; in Go, start each entry from GetDefaultOptions
+	// as with NewWithOptions. SetOptions and Provider take precedence; the
+	// Provider and PerHost fields of the entries are ignored, and each Expvar
+	// must be unique.
+	// Optional. Default value nil.
+	PerHost HostOptions `yaml:"per_host" json:"per_host"`
+}
+
+// ETagStrategy defines how strong ETags are rewritten for compressed responses.
+// Compressing changes the representation, so the handler's strong validator no
+// longer identifies the bytes that are sent.
+type ETagStrategy int
+
+const (
+	// ETagWeaken turns a strong ETag into a weak one ("abc" becomes W/"abc").
+	ETagWeaken ETagStrategy = iota
+	// ETagSuffix appends the content coding to a strong ETag ("abc" becomes
+	// "abc-gzip") and strips the suffix from conditional request headers
+	// before the handler sees them.
+	ETagSuffix
+	// ETagKeep leaves ETags untouched.
+	ETagKeep
+)
+
+var etagStrategyNames = map[ETagStrategy]string{
+	ETagWeaken: "weaken",
+	ETagSuffix: "suffix",
+	ETagKeep:   "keep",
+}
+
+// String returns the name of the strategy.
+func (s ETagStrategy) String() string {
+	if name, ok := etagStrategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("ETagStrategy(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the strategy is
+// written by name in configuration files.
+func (s ETagStrategy) MarshalText() ([]byte, error) {
+	if _, ok := etagStrategyNames[s]; !ok {
+		return nil, fmt.Errorf("compress: unknown etag strategy %d", int(s))
+	}
+	return []byte(s.String()), nil
 }
 
-type gzipResponseWriter struct {
-	io.Writer
-	http.ResponseWriter
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *ETagStrategy) UnmarshalText(text []byte) error {
+	for strategy, name := range etagStrategyNames {
+		if name == string(text) {
+			*s = strategy
+			return nil
+		}
+	}
+	return fmt.Errorf("compress: unknown etag strategy %q", text)
 }
 
+// VaryStrategy defines how the middleware contributes Accept-Encoding to the
+// Vary header.
+type VaryStrategy int
+
+const (
+	// VaryMerge adds Accept-Encoding to the fields already listed, unless
+	// it is among them or Vary is "*".
+	VaryMerge VaryStrategy = iota
+	// VaryReplace sets Vary to Accept-Encoding, dropping the fields listed
+	// before, for caches that only key on it.
+	VaryReplace
+	// VarySkip leaves Vary untouched, for when a CDN or other middleware
+	// manages it. Caches may then serve compressed responses to clients
+	// that do not accept them.
+	VarySkip
+)
+
+var varyStrategyNames = map[VaryStrategy]string{
+	VaryMerge:   "merge",
+	VaryReplace: "replace",
+	VarySkip:    "skip",
+}
+
+// String returns the name of the strategy.
+func (s VaryStrategy) String() string {
+	if name, ok := varyStrategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("VaryStrategy(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the strategy is
+// written by name in configuration files.
+func (s VaryStrategy) MarshalText() ([]byte, error) {
+	if _, ok := varyStrategyNames[s]; !ok {
+		return nil, fmt.Errorf("compress: unknown vary strategy %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *VaryStrategy) UnmarshalText(text []byte) error {
+	for strategy, name := range varyStrategyNames {
+		if name == string(text) {
+			*s = strategy
+			return nil
+		}
+	}
+	return fmt.Errorf("compress: unknown vary strategy %q", text)
+}
+
+// Headers
+const (
+	// HeaderOriginalLength carries the uncompressed length of a response.
+	HeaderOriginalLength = "X-Original-Length"
+	// HeaderCompressionRatio carries the compressed to uncompressed size
+	// ratio of a response.
+	HeaderCompressionRatio = "X-Compression-Ratio"
+	// HeaderCompress carries the debug information added by DebugHeader.
+	HeaderCompress = "X-Compress"
+	// HeaderPadding carries the filler added by LengthPadding.
+	HeaderPadding = "X-Padding"
+)
+
+// Encoding is a content coding, as listed in Accept-Encoding and
+// Content-Encoding.
+type Encoding string
+
+// Encodings
 const (
-	gzipScheme = "gzip"
+	// EncodingGzip is the coding the middleware compresses with.
+	EncodingGzip Encoding = "gzip"
+	// EncodingDeflate is the zlib coding, which Transport decodes.
+	EncodingDeflate Encoding = "deflate"
+	// EncodingBrotli and EncodingZstd name codings that clients may
+	// accept; they are not produced by the middleware.
+	EncodingBrotli Encoding = "br"
+	EncodingZstd   Encoding = "zstd"
+	// EncodingIdentity means no compression.
+	EncodingIdentity Encoding = "identity"
+)
+
+const (
+	headerETag        = "ETag"
+	headerIfMatch     = "If-Match"
+	headerIfNoneMatch = "If-None-Match"
+	headerTrailer     = "Trailer"
+
+	headerCacheControl = "Cache-Control"
+	headerCookie       = "Cookie"
+	headerSetCookie    = "Set-Cookie"
+	headerSecFetchSite = "Sec-Fetch-Site"
+
+	headerConnection       = "Connection"
+	headerTransferEncoding = "Transfer-Encoding"
+
+	headerContentDigest = "Content-Digest"
+	headerReprDigest    = "Repr-Digest"
+
+	headerRange = "Range"
 )
 
+// Errors
+var (
+	// ErrHijackNotSupported is returned by Hijack when the underlying writer
+	// does not implement http.Hijacker.
+	ErrHijackNotSupported = errors.New("compress: hijacking not supported by the underlying writer")
+
+	// ErrInvalidLevel is returned for a compression level gzip does not
+	// support.
+	ErrInvalidLevel = errors.New("compress: invalid compression level")
+	// ErrInvalidOption is returned for an option value out of range, such
+	// as a negative length or a rate above 1.
+	ErrInvalidOption = errors.New("compress: invalid option")
+	// ErrUnknownDigest is returned for a Digest algorithm that is not
+	// supported.
+	ErrUnknownDigest = errors.New("compress: unknown digest algorithm")
+	// ErrConflictingOptions is returned for options that cannot be used
+	// together.
+	ErrConflictingOptions = errors.New("compress: conflicting options")
+	// ErrUnsupportedEncoding is returned by NewReader and NewWriter for a
+	// content coding the package has no codec for.
+	ErrUnsupportedEncoding = errors.New("compress: unsupported encoding")
+)
+
+// Op names the step of the compression pipeline an Error occurred in.
+type Op string
+
+// Ops
+const (
+	// OpInit is the creation of the compressor for a response.
+	OpInit Op = "init"
+	// OpWrite is the compression of data written by the handler.
+	OpWrite Op = "write"
+	// OpFlush is a flush requested by the handler.
+	OpFlush Op = "flush"
+	// OpClose is the completion of the compressed stream once the handler
+	// has returned.
+	OpClose Op = "close"
+)
+
+// Error is the error type of failures while compressing or sending a
+// response. It wraps the underlying error, so errors.Is and errors.As see
+// through it.
+type Error struct {
+	// Op is the step that failed.
+	Op Op
+	// Client is set when the failure was caused by the client rather than
+	// by the server: the request was cancelled or the connection could not
+	// be written to.
+	Client bool
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *Error) Error() string {
+	return "compress: " + string(e.Op) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
 // Option defines option func.
 type Option func(*Options)
 
-// GetDefaultOptions returns default options.
+var (
+	defaultOptionsMu sync.RWMutex
+	defaultOptions   = builtinOptions()
+)
+
+// GetDefaultOptions returns default options, as set by SetDefaultOptions.
 func GetDefaultOptions() Options {
+	defaultOptionsMu.RLock()
+	defer defaultOptionsMu.RUnlock()
+	return defaultOptions.clone()
+}
+
+// SetDefaultOptions replaces the default options of the package, which New
+// starts from, for example to set MinLength once for every mux of an
+// application. Middleware created before the call keeps its options. It
+// panics if opts are invalid, see Options.Validate, or set Expvar, which can
+// only be published once.
+func SetDefaultOptions(opts Options) {
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+	if opts.Expvar != "" {
+		panic(fmt.Errorf("%w: Expvar cannot be a default", ErrInvalidOption))
+	}
+	defaults := builtinOptions()
+	if opts.Skipper == nil {
+		opts.Skipper = defaults.Skipper
+	}
+	if opts.LimitKey == nil {
+		opts.LimitKey = defaults.LimitKey
+	}
+	if opts.RolloutKey == nil {
+		opts.RolloutKey = defaults.RolloutKey
+	}
+	defaultOptionsMu.Lock()
+	defaultOptions = opts.clone()
+	defaultOptionsMu.Unlock()
+}
+
+// clone returns a copy of o that shares no slices with it.
+func (o Options) clone() Options {
+	o.Digest = append([]string(nil), o.Digest...)
+	o.ExcludedContentTypes = append([]string(nil), o.ExcludedContentTypes...)
+	o.BodylessStatuses = append([]int(nil), o.BodylessStatuses...)
+	if o.Aliases != nil {
+		aliases := make(map[string]Encoding, len(o.Aliases))
+		for alias, encoding := range o.Aliases {
+			aliases[alias] = encoding
+		}
+		o.Aliases = aliases
+	}
+	if o.FlushPolicies != nil {
+		policies := make(map[string]FlushStrategy, len(o.FlushPolicies))
+		for mt, s := range o.FlushPolicies {
+			policies[mt] = s
+		}
+		o.FlushPolicies = policies
+	}
+	if o.PerHost != nil {
+		hosts := make(HostOptions, len(o.PerHost))
+		for host, opts := range o.PerHost {
+			hosts[host] = opts.clone()
+		}
+		o.PerHost = hosts
+	}
+	return o
+}
+
+// builtinOptions returns the default options of the package.
+func builtinOptions() Options {
 	return Options{
 		Skipper: route.DefaultSkipper,
 		Level:   -1,
+		ETag:    ETagWeaken,
+
+		MaxBufferSize:    1 << 20,
+		RolloutPercent:   100,
+		FlushEvents:      true,
+		BodylessStatuses: []int{http.StatusNoContent, http.StatusNotModified},
+		ShadowRate:       1,
+		SniffLength:      512,
+		LimitKey: func(c route.Context) string {
+			return remoteHost(c.Request())
+		},
+		RolloutKey: func(c route.Context) string {
+			return remoteHost(c.Request())
+		},
 	}
 }
 
@@ -56,69 +709,865 @@ func Level(level int) Option {
 	}
 }
 
-// New return Gzip middleware.
+// ETag sets etag option.
+func ETag(strategy ETagStrategy) Option {
+	return func(o *Options) {
+		o.ETag = strategy
+	}
+}
+
+// ComputeETag sets compute etag option.
+func ComputeETag(compute bool) Option {
+	return func(o *Options) {
+		o.ComputeETag = compute
+	}
+}
+
+// Buffer sets buffer option.
+func Buffer(buffer bool) Option {
+	return func(o *Options) {
+		o.Buffer = buffer
+	}
+}
+
+// Digest sets digest option.
+func Digest(algorithms ...string) Option {
+	return func(o *Options) {
+		o.Digest = algorithms
+	}
+}
+
+// UncompressedLengthHeader sets uncompressed length header option.
+func UncompressedLengthHeader(name string) Option {
+	return func(o *Options) {
+		o.UncompressedLengthHeader = name
+	}
+}
+
+// HTTP2Buffer sets http2 buffer option.
+func HTTP2Buffer(buffer bool) Option {
+	return func(o *Options) {
+		o.HTTP2Buffer = buffer
+	}
+}
+
+// StatsTrailers sets stats trailers option.
+func StatsTrailers(send bool) Option {
+	return func(o *Options) {
+		o.StatsTrailers = send
+	}
+}
+
+// DebugHeader sets debug header option.
+func DebugHeader(debug bool) Option {
+	return func(o *Options) {
+		o.DebugHeader = debug
+	}
+}
+
+// MaxBufferSize sets max buffer size option.
+func MaxBufferSize(size int) Option {
+	return func(o *Options) {
+		o.MaxBufferSize = size
+	}
+}
+
+// FlushInterval sets flush interval option.
+func FlushInterval(d time.Duration) Option {
+	return func(o *Options) {
+		o.FlushInterval = d
+	}
+}
+
+// FlushEvents sets flush events option.
+func FlushEvents(flush bool) Option {
+	return func(o *Options) {
+		o.FlushEvents = flush
+	}
+}
+
+// FlushRecords sets flush records option.
+func FlushRecords(flush bool) Option {
+	return func(o *Options) {
+		o.FlushRecords = flush
+	}
+}
+
+// FlushPolicies sets flush policies option.
+func FlushPolicies(policies map[string]FlushStrategy) Option {
+	return func(o *Options) {
+		o.FlushPolicies = policies
+	}
+}
+
+// WriteThrough sets write through option.
+func WriteThrough(fn func(c route.Context) bool) Option {
+	return func(o *Options) {
+		o.WriteThrough = fn
+	}
+}
+
+// BodylessStatuses sets bodyless statuses option.
+func BodylessStatuses(codes ...int) Option {
+	return func(o *Options) {
+		o.BodylessStatuses = codes
+	}
+}
+
+// MinLength sets min length option.
+func MinLength(length int) Option {
+	return func(o *Options) {
+		o.MinLength = length
+	}
+}
+
+// ExcludedContentTypes sets excluded content types option.
+func ExcludedContentTypes(types ...string) Option {
+	return func(o *Options) {
+		o.ExcludedContentTypes = types
+	}
+}
+
+// Sniffer sets sniffer option.
+func Sniffer(fn func(c route.Context, data []byte) string) Option {
+	return func(o *Options) {
+		o.Sniffer = fn
+	}
+}
+
+// SniffLength sets sniff length option.
+func SniffLength(length int) Option {
+	return func(o *Options) {
+		o.SniffLength = length
+	}
+}
+
+// SkipAuthenticated sets skip authenticated option.
+func SkipAuthenticated(skip bool) Option {
+	return func(o *Options) {
+		o.SkipAuthenticated = skip
+	}
+}
+
+// SkipSetCookie sets skip set cookie option.
+func SkipSetCookie(skip bool) Option {
+	return func(o *Options) {
+		o.SkipSetCookie = skip
+	}
+}
+
+// SkipCrossOrigin sets skip cross origin option.
+func SkipCrossOrigin(skip bool) Option {
+	return func(o *Options) {
+		o.SkipCrossOrigin = skip
+	}
+}
+
+// Sensitive sets sensitive option.
+func Sensitive(fn func(c route.Context) bool) Option {
+	return func(o *Options) {
+		o.Sensitive = fn
+	}
+}
+
+// GzipPadding sets gzip padding option.
+func GzipPadding(max int) Option {
+	return func(o *Options) {
+		o.GzipPadding = max
+	}
+}
+
+// LengthPadding sets length padding option.
+func LengthPadding(quantum int) Option {
+	return func(o *Options) {
+		o.LengthPadding = quantum
+	}
+}
+
+// AbortOnError sets abort on error option.
+func AbortOnError(abort bool) Option {
+	return func(o *Options) {
+		o.AbortOnError = abort
+	}
+}
+
+// OnError sets on error option.
+func OnError(fn func(c route.Context, err error)) Option {
+	return func(o *Options) {
+		o.OnError = fn
+	}
+}
+
+// ConditionalVary sets conditional vary option.
+func ConditionalVary(conditional bool) Option {
+	return func(o *Options) {
+		o.ConditionalVary = conditional
+	}
+}
+
+// Vary sets vary option.
+func Vary(strategy VaryStrategy) Option {
+	return func(o *Options) {
+		o.Vary = strategy
+	}
+}
+
+// OnComplete sets on complete option.
+func OnComplete(fn func(c route.Context, s Stats)) Option {
+	return func(o *Options) {
+		o.OnComplete = fn
+	}
+}
+
+// OnSkip sets on skip option.
+func OnSkip(fn func(c route.Context, reason SkipReason)) Option {
+	return func(o *Options) {
+		o.OnSkip = fn
+	}
+}
+
+// AnomalyFactor sets anomaly factor option.
+func AnomalyFactor(factor float64) Option {
+	return func(o *Options) {
+		o.AnomalyFactor = factor
+	}
+}
+
+// OnAnomaly sets on anomaly option.
+func OnAnomaly(fn func(c route.Context, s Stats, baseline float64)) Option {
+	return func(o *Options) {
+		o.OnAnomaly = fn
+	}
+}
+
+// Logger sets logger option.
+func Logger(logger *slog.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// Shadow sets shadow option.
+func Shadow(shadow bool) Option {
+	return func(o *Options) {
+		o.Shadow = shadow
+	}
+}
+
+// ShadowRate sets shadow rate option.
+func ShadowRate(rate float64) Option {
+	return func(o *Options) {
+		o.ShadowRate = rate
+	}
+}
+
+// NegotiationLogRate sets negotiation log rate option.
+func NegotiationLogRate(rate float64) Option {
+	return func(o *Options) {
+		o.NegotiationLogRate = rate
+	}
+}
+
+// Aliases sets aliases option.
+func Aliases(aliases map[string]Encoding) Option {
+	return func(o *Options) {
+		o.Aliases = aliases
+	}
+}
+
+// Selector sets selector option.
+func Selector(selector func(c route.Context) (encoding string, level int, ok bool)) Option {
+	return func(o *Options) {
+		o.Selector = selector
+	}
+}
+
+// Collect sets collector option.
+func Collect(collector *Collector) Option {
+	return func(o *Options) {
+		o.Collector = collector
+	}
+}
+
+// Limit sets limiter option.
+func Limit(limiter *Limiter) Option {
+	return func(o *Options) {
+		o.Limiter = limiter
+	}
+}
+
+// LimitKey sets limit key option.
+func LimitKey(fn func(c route.Context) string) Option {
+	return func(o *Options) {
+		o.LimitKey = fn
+	}
+}
+
+// RolloutPercent sets rollout percent option.
+func RolloutPercent(percent float64) Option {
+	return func(o *Options) {
+		o.RolloutPercent = percent
+	}
+}
+
+// RolloutKey sets rollout key option.
+func RolloutKey(fn func(c route.Context) string) Option {
+	return func(o *Options) {
+		o.RolloutKey = fn
+	}
+}
+
+// Expvar sets expvar option.
+func Expvar(name string) Option {
+	return func(o *Options) {
+		o.Expvar = name
+	}
+}
+
+// Disabled sets disabled option.
+func Disabled(disabled bool) Option {
+	return func(o *Options) {
+		o.Disabled = disabled
+	}
+}
+
+// Edge sets edge option.
+func Edge(edge bool) Option {
+	return func(o *Options) {
+		o.Edge = edge
+	}
+}
+
+// Transcode sets transcode option.
+func Transcode(transcode bool) Option {
+	return func(o *Options) {
+		o.Transcode = transcode
+	}
+}
+
+// Provider sets provider option.
+func Provider(provider func(c route.Context) *Options) Option {
+	return func(o *Options) {
+		o.Provider = provider
+	}
+}
+
+// PerHost sets per host option.
+func PerHost(hosts map[string]Options) Option {
+	return func(o *Options) {
+		o.PerHost = hosts
+	}
+}
+
+// New return Gzip middleware. It panics if the options are invalid, see
+// Options.Validate. Middleware attached to a route group overrides the one
+// installed with Mux.Use for the routes of the group.
 func New(options ...Option) route.MiddlewareFunc {
 	// Apply options.
 	opts := GetDefaultOptions()
 	for _, opt := range options {
 		opt(&opts)
 	}
+	if err := opts.Validate(); err != nil {
+		panic(err)
+	}
+	return newMiddleware(opts)
+}
 
-	return func(c route.Context, next route.HandlerFunc) error {
-		if opts.Skipper(c) {
-			return next(c)
+// NewGzip returns Gzip middleware, like New. gzip is the only coding the
+// package produces, so that it needs no dependency beyond the standard
+// library; NewGzip names the algorithm for code that wants to be explicit
+// about it.
+func NewGzip(options ...Option) route.MiddlewareFunc {
+	return New(options...)
+}
+
+// NewWithOptions returns Gzip middleware configured by opts, for example
+// options loaded from a configuration file. Fields left at their zero value
+// keep it rather than the default, so start from GetDefaultOptions. It
+// returns the error of Validate if the options are invalid.
+func NewWithOptions(opts Options) (route.MiddlewareFunc, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return newMiddleware(opts), nil
+}
+
+// Validate checks the options. The error wraps ErrInvalidLevel,
+// ErrInvalidOption, ErrUnknownDigest or ErrConflictingOptions.
+func (o Options) Validate() error {
+	if o.Level < gzip.HuffmanOnly || o.Level > gzip.BestCompression {
+		return fmt.Errorf("%w: %d", ErrInvalidLevel, o.Level)
+	}
+	for name, v := range map[string]int{
+		"MaxBufferSize": o.MaxBufferSize,
+		"MinLength":     o.MinLength,
+		"GzipPadding":   o.GzipPadding,
+		"LengthPadding": o.LengthPadding,
+		"SniffLength":   o.SniffLength,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%w: %s is negative", ErrInvalidOption, name)
+		}
+	}
+	if o.FlushInterval < 0 {
+		return fmt.Errorf("%w: FlushInterval is negative", ErrInvalidOption)
+	}
+	for mt, s := range o.FlushPolicies {
+		if _, ok := flushStrategyNames[s]; !ok {
+			return fmt.Errorf("%w: unknown flush strategy %d for %q", ErrInvalidOption, int(s), mt)
+		}
+		if s == FlushTimed && o.FlushInterval == 0 {
+			return fmt.Errorf("%w: the %s flush strategy for %q needs FlushInterval", ErrConflictingOptions, s, mt)
+		}
+	}
+	for name, v := range map[string]float64{
+		"ShadowRate":         o.ShadowRate,
+		"NegotiationLogRate": o.NegotiationLogRate,
+	} {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("%w: %s is not between 0 and 1", ErrInvalidOption, name)
+		}
+	}
+	if o.RolloutPercent < 0 || o.RolloutPercent > 100 {
+		return fmt.Errorf("%w: RolloutPercent is not between 0 and 100", ErrInvalidOption)
+	}
+	if o.AnomalyFactor != 0 && o.AnomalyFactor <= 1 {
+		return fmt.Errorf("%w: AnomalyFactor must be above 1", ErrInvalidOption)
+	}
+	for alias, encoding := range o.Aliases {
+		if !knownCoding(encoding) {
+			return fmt.Errorf("%w: alias %q stands for unknown encoding %q", ErrInvalidOption, alias, encoding)
+		}
+	}
+	for _, alg := range o.Digest {
+		if _, ok := digestAlgorithms[strings.ToLower(alg)]; !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownDigest, alg)
+		}
+	}
+	if o.Shadow && (o.Buffer || o.ComputeETag || len(o.Digest) > 0 || o.LengthPadding > 0) {
+		return fmt.Errorf("%w: Shadow never alters responses, so Buffer, ComputeETag, Digest and LengthPadding have no effect", ErrConflictingOptions)
+	}
+	if o.ComputeETag && o.GzipPadding > 0 {
+		return fmt.Errorf("%w: GzipPadding makes every compressed body, and so its computed ETag, differ", ErrConflictingOptions)
+	}
+	if o.Expvar != "" && expvar.Get(o.Expvar) != nil {
+		return fmt.Errorf("%w: expvar %q is already published", ErrInvalidOption, o.Expvar)
+	}
+	expvars := map[string]bool{o.Expvar: o.Expvar != ""}
+	for host, opts := range o.PerHost {
+		opts.Provider, opts.PerHost = nil, nil
+		if err := opts.Validate(); err != nil {
+			return fmt.Errorf("%w, for host %q", err, host)
+		}
+		if opts.Expvar != "" && expvars[opts.Expvar] {
+			return fmt.Errorf("%w: expvar %q is published twice, for host %q", ErrInvalidOption, opts.Expvar, host)
 		}
+		expvars[opts.Expvar] = true
+	}
+	return nil
+}
 
+// newGzip returns Gzip middleware for opts, ignoring their Provider.
+func newGzip(opts Options) route.MiddlewareFunc {
+	defaults := builtinOptions()
+	if opts.Skipper == nil {
+		opts.Skipper = defaults.Skipper
+	}
+	if opts.LimitKey == nil {
+		opts.LimitKey = defaults.LimitKey
+	}
+	if opts.RolloutKey == nil {
+		opts.RolloutKey = defaults.RolloutKey
+	}
+	if opts.Expvar != "" {
+		if opts.Collector == nil {
+			opts.Collector = NewCollector()
+		}
+		opts.Collector.Publish(opts.Expvar)
+	}
+	pool := &gzipWriters[opts.Level-gzip.HuffmanOnly]
+	aliases := make(map[string]Encoding, len(opts.Aliases))
+	for alias, encoding := range opts.Aliases {
+		aliases[strings.ToLower(alias)] = encoding
+	}
+	flushPolicies := make(map[string]FlushStrategy, len(opts.FlushPolicies))
+	for mt, s := range opts.FlushPolicies {
+		flushPolicies[strings.ToLower(mt)] = s
+	}
+	bodyless := make(map[int]bool, len(opts.BodylessStatuses))
+	for _, code := range opts.BodylessStatuses {
+		bodyless[code] = true
+	}
+	skipped := func(c route.Context, reason SkipReason) {
+		if opts.Logger != nil {
+			level, msg := slog.LevelDebug, "compress: response not compressed"
+			if reason == SkipError {
+				level, msg = slog.LevelInfo, "compress: buffered response dropped after handler error"
+			}
+			opts.Logger.LogAttrs(c.Request().Context(), level, msg,
+				slog.String("path", c.Request().URL.Path),
+				slog.String("reason", reason.String()))
+		}
+		if opts.OnSkip != nil {
+			opts.OnSkip(c, reason)
+		}
+	}
+	var anomalies *detector
+	if opts.AnomalyFactor > 0 {
+		anomalies = newDetector(opts.AnomalyFactor)
+	}
+	complete := func(c route.Context, s Stats, reason SkipReason) {
+		s.ContentType, _, _ = mime.ParseMediaType(c.Response().Header().Get(route.HeaderContentType))
+		store(c, s, reason)
+		opts.Collector.record(s, reason)
+		if reason != 0 {
+			skipped(c, reason)
+		}
+		if anomalies != nil && reason == 0 && s.UncompressedSize > 0 {
+			path := c.Path()
+			if path == "" {
+				path = c.Request().URL.Path
+			}
+			ratio := float64(s.CompressedSize) / float64(s.UncompressedSize)
+			if baseline, ok := anomalies.observe(path, ratio); ok {
+				opts.Collector.anomaly()
+				if opts.Logger != nil {
+					opts.Logger.LogAttrs(c.Request().Context(), slog.LevelWarn, "compress: anomalous compression ratio",
+						slog.String("path", c.Request().URL.Path),
+						slog.Float64("ratio", ratio),
+						slog.Float64("baseline", baseline))
+				}
+				if opts.OnAnomaly != nil {
+					opts.OnAnomaly(c, s, baseline)
+				}
+			}
+		}
+		if opts.OnComplete != nil {
+			opts.OnComplete(c, s)
+		}
+	}
+
+	return func(c route.Context, next route.HandlerFunc) error {
 		res := c.Response()
-		res.Header().Add(route.HeaderVary, route.HeaderAcceptEncoding)
-		if strings.Contains(c.Request().Header.Get(route.HeaderAcceptEncoding), gzipScheme) {
-			res.Header().Set(route.HeaderContentEncoding, gzipScheme)
-			rw := res.Writer
-			w, err := gzip.NewWriterLevel(rw, opts.Level)
-			if err != nil {
-				return err
-			}
-			defer func() {
-				if res.Size == 0 {
-					if res.Header().Get(route.HeaderContentEncoding) == gzipScheme {
-						res.Header().Del(route.HeaderContentEncoding)
+		// An instance of the middleware that runs first, such as a global
+		// one, gives way to this one, attached to a route group. It can only
+		// do so if no other writer was installed in between: otherwise it
+		// keeps handling the response.
+		if outer, ok := res.Writer.(*ResponseWriter); ok {
+			if w, ok := outer.yield(); ok {
+				res.Writer = w
+			}
+		}
+		if opts.Disabled || wrapped(res.Writer) {
+			return next(c)
+		}
+		level, pool := opts.Level, pool
+		var selectIdentity bool
+		if opts.Selector != nil {
+			if encoding, l, ok := opts.Selector(c); ok {
+				switch Encoding(strings.ToLower(strings.TrimSpace(encoding))) {
+				case EncodingIdentity:
+					selectIdentity = true
+				case EncodingGzip, "x-gzip", "":
+					if l != 0 {
+						if l < gzip.HuffmanOnly || l > gzip.BestCompression {
+							return fmt.Errorf("%w: %d", ErrInvalidLevel, l)
+						}
+						level, pool = l, &gzipWriters[l-gzip.HuffmanOnly]
 					}
-					// We have to reset response to it's pristine state when
-					// nothing is written to body or error is returned.
-					res.Writer = rw
-					w.Reset(ioutil.Discard)
 				}
-				w.Close()
-			}()
-			grw := &gzipResponseWriter{Writer: w, ResponseWriter: rw}
-			res.Writer = grw
+			}
+		}
+		acceptEncoding := strings.Join(c.Request().Header.Values(route.HeaderAcceptEncoding), ",")
+		codings := parseAcceptEncoding(acceptEncoding, aliases)
+		accepted := accepts(codings, EncodingGzip)
+		if opts.Logger != nil && opts.NegotiationLogRate > 0 && rand.Float64() < opts.NegotiationLogRate {
+			chosen := EncodingIdentity
+			if accepted {
+				chosen = EncodingGzip
+			}
+			parsed := make([]string, len(codings))
+			for i, a := range codings {
+				parsed[i] = a.String()
+			}
+			opts.Logger.LogAttrs(c.Request().Context(), slog.LevelDebug, "compress: negotiated content coding",
+				slog.String("path", c.Request().URL.Path),
+				slog.String("accept_encoding", acceptEncoding),
+				slog.Any("parsed", parsed),
+				slog.String("chosen", string(chosen)))
+		}
+		var saved headerSnapshot
+		if opts.Edge {
+			saved.save(c.Request().Header, route.HeaderAcceptEncoding)
+			c.Request().Header.Del(route.HeaderAcceptEncoding)
+		}
+		var skip SkipReason
+		switch {
+		case selectIdentity:
+			skip = SkipSelected
+		case opts.Skipper(c):
+			skip = SkipSkipper
+		case isUpgrade(c.Request().Header):
+			// The connection is about to be taken over by another protocol.
+			skip = SkipUpgrade
+		case opts.SkipAuthenticated && credentialed(c.Request()):
+			skip = SkipCredentials
+		case opts.SkipCrossOrigin && credentialed(c.Request()) && crossOrigin(c.Request()):
+			skip = SkipCrossSite
+		case opts.Sensitive != nil && opts.Sensitive(c):
+			skip = SkipSensitive
+		case accepted && opts.Limiter != nil && !opts.Limiter.allow(opts.LimitKey(c)):
+			skip = SkipRateLimited
+		case opts.Shadow && !accepted:
+			skip = SkipNotAccepted
+		case opts.Shadow && rand.Float64() >= opts.ShadowRate:
+			skip = SkipNotSampled
+		case accepted && opts.RolloutPercent < 100 && !inRollout(opts.RolloutKey(c), opts.RolloutPercent):
+			skip = SkipNotSampled
+		}
+		if skip != 0 {
+			err := next(c)
+			complete(c, Stats{UncompressedSize: res.Size, CompressedSize: res.Size}, skip)
+			return err
 		}
-		return next(c)
+
+		if !opts.ConditionalVary && !opts.Shadow {
+			saved.save(res.Header(), route.HeaderVary)
+			setVary(res.Header(), opts.Vary)
+		}
+		if !accepted && !opts.ConditionalVary && !opts.Transcode {
+			if opts.DebugHeader {
+				res.Header().Set(HeaderCompress, string(EncodingIdentity)+";reason="+SkipNotAccepted.String())
+			}
+			err := next(c)
+			complete(c, Stats{UncompressedSize: res.Size, CompressedSize: res.Size}, SkipNotAccepted)
+			return err
+		}
+		if accepted && !opts.Shadow && opts.ETag == ETagSuffix {
+			req := c.Request().Header
+			for _, k := range []string{headerIfMatch, headerIfNoneMatch} {
+				if v := req.Get(k); v != "" {
+					saved.save(req, k)
+					req.Set(k, strings.Replace(v, "-"+string(EncodingGzip)+`"`, `"`, -1))
+				}
+			}
+		}
+		rw := res.Writer
+		grw := &ResponseWriter{
+			ResponseWriter: rw,
+			saved:          saved,
+			pool:           pool,
+			level:          level,
+			etag:           opts.ETag,
+			computeETag:    opts.ComputeETag,
+			digests:        opts.Digest,
+			lengthHdr:      opts.UncompressedLengthHeader,
+			statsTrailers:  opts.StatsTrailers,
+			debug:          opts.DebugHeader && !opts.Shadow,
+			req:            c.Request(),
+			bodyless:       bodyless,
+			identity:       !accepted || opts.Shadow,
+			shadow:         opts.Shadow,
+			minLength:      opts.MinLength,
+			excluded:       opts.ExcludedContentTypes,
+			sniffLength:    opts.SniffLength,
+			flushInterval:  opts.FlushInterval,
+			flushEvents:    opts.FlushEvents,
+			flushRecords:   opts.FlushRecords,
+			flushPolicies:  flushPolicies,
+			transcode:      opts.Transcode,
+			codings:        codings,
+			padding:        opts.GzipPadding,
+			lengthPadding:  opts.LengthPadding,
+			skipSetCookie:  opts.SkipSetCookie,
+			vary:           opts.ConditionalVary && !opts.Shadow,
+			varyStrategy:   opts.Vary,
+			h2:             c.Request().ProtoMajor == 2,
+			declared:       -1,
+			sensitive: func() bool {
+				sensitive, _ := c.Get(SensitiveKey).(bool)
+				return sensitive
+			},
+			writeThrough: func() bool {
+				if through, _ := c.Get(WriteThroughKey).(bool); through {
+					return true
+				}
+				return opts.WriteThrough != nil && opts.WriteThrough(c)
+			},
+		}
+		if opts.Sniffer != nil {
+			grw.sniff = func(data []byte) string {
+				return opts.Sniffer(c, data)
+			}
+		}
+		// header is the response header before the handler ran, put back
+		// if a buffered response is dropped.
+		var header http.Header
+		if accepted && !opts.Shadow && (opts.Buffer || opts.ComputeETag || len(opts.Digest) > 0 || grw.h2 && opts.HTTP2Buffer) {
+			grw.buf = new(bytes.Buffer)
+			grw.maxBuf = opts.MaxBufferSize
+			header = res.Header().Clone()
+		}
+		defer func() {
+			// Anything written after the handler returns, such as the
+			// error handler's response, goes to the client uncompressed.
+			res.Writer = rw
+			if r := recover(); r != nil {
+				grw.stopFlush()
+				grw.abort()
+				panic(r)
+			}
+		}()
+		res.Writer = grw
+		err := next(c)
+		grw.stopFlush()
+		if grw.yielded {
+			// A nested instance handled and recorded the response.
+			return err
+		}
+		if err != nil && grw.fail(opts.AbortOnError) {
+			// Nothing reached the client, so the error handler may
+			// still send its own response, without the headers set
+			// for the one dropped.
+			h := res.Header()
+			for k := range h {
+				delete(h, k)
+			}
+			for k, v := range header {
+				h[k] = v
+			}
+			res.Committed = false
+			res.Status = http.StatusOK
+			res.Size = 0
+			c.Set(SkipReasonKey, SkipError)
+			opts.Collector.record(Stats{}, SkipError)
+			skipped(c, SkipError)
+		} else {
+			if err == nil {
+				err = grw.finish()
+			}
+			s := grw.stats()
+			complete(c, s, grw.skipReason())
+			if opts.Limiter != nil && s.Encoding != "" {
+				opts.Limiter.use(opts.LimitKey(c), s.UncompressedSize)
+			}
+		}
+		if grw.err != nil && opts.Logger != nil {
+			level := slog.LevelError
+			var e *Error
+			if errors.As(grw.err, &e) && e.Client {
+				level = slog.LevelDebug
+			}
+			opts.Logger.LogAttrs(c.Request().Context(), level, "compress: response failed",
+				slog.String("path", c.Request().URL.Path),
+				slog.Any("error", grw.err))
+		}
+		if grw.err != nil && opts.OnError != nil {
+			opts.OnError(c, grw.err)
+		}
+		return err
 	}
 }
 
-func (w *gzipResponseWriter) WriteHeader(code int) {
-	if code == http.StatusNoContent {
-		w.ResponseWriter.Header().Del(route.HeaderContentEncoding)
+// SniffExtension is a Sniffer that returns the media type registered for the
+// extension of the request path with the mime package, "" if there is none.
+func SniffExtension(c route.Context, data []byte) string {
+	return mime.TypeByExtension(path.Ext(c.Request().URL.Path))
+}
+
+// MarkSensitive marks the response of c as mixing secrets with
+// attacker-controlled input, so that it is sent uncompressed. It must be
+// called before the first byte of the body is written.
+func MarkSensitive(c route.Context) {
+	c.Set(SensitiveKey, true)
+}
+
+// credentialed reports whether r carries a Cookie or Authorization header.
+func credentialed(r *http.Request) bool {
+	return r.Header.Get(route.HeaderAuthorization) != "" || r.Header.Get(headerCookie) != ""
+}
+
+// crossOrigin reports whether r was sent from another origin, going by
+// Sec-Fetch-Site if the client sent it, or else by the Origin header.
+func crossOrigin(r *http.Request) bool {
+	if site := r.Header.Get(headerSecFetchSite); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+	origin := r.Header.Get(route.HeaderOrigin)
+	if origin == "" {
+		return false
 	}
-	w.Header().Del(route.HeaderContentLength)
-	w.ResponseWriter.WriteHeader(code)
+	u, err := url.Parse(origin)
+	if err != nil {
+		return true
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get(route.HeaderXForwardedProto); proto != "" {
+		scheme = proto
+	}
+	return !strings.EqualFold(u.Scheme, scheme) || !strings.EqualFold(u.Host, r.Host)
+}
+
+// ResponseController returns an http.ResponseController for the response of
+// c. route.Response does not expose its writer to http.NewResponseController,
+// so handlers running behind this middleware use it to set deadlines or
+// enable full duplex on the underlying connection.
+func ResponseController(c route.Context) *http.ResponseController {
+	return http.NewResponseController(c.Response().Writer)
+}
+
+// GetWriter returns the ResponseWriter of the middleware handling the
+// response of c, looking through writers installed after it that have an
+// Unwrap method. ok is false outside of the middleware.
+func GetWriter(c route.Context) (w *ResponseWriter, ok bool) {
+	return findWriter(c.Response().Writer)
 }
 
-func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	if w.Header().Get(route.HeaderContentType) == "" {
-		w.Header().Set(route.HeaderContentType, http.DetectContentType(b))
+// findWriter returns w, or the writer it wraps, that is a ResponseWriter.
+func findWriter(w http.ResponseWriter) (*ResponseWriter, bool) {
+	for {
+		switch v := w.(type) {
+		case *ResponseWriter:
+			return v, true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil, false
+		}
 	}
-	return w.Writer.Write(b)
 }
 
-func (w *gzipResponseWriter) Flush() {
-	w.Writer.(*gzip.Writer).Flush()
-	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
-		flusher.Flush()
+// wrapped reports whether w, or a writer it wraps, is already a compressing
+// writer of this package.
+func wrapped(w http.ResponseWriter) bool {
+	_, ok := findWriter(w)
+	return ok
+}
+
+// setVary adds Accept-Encoding to the Vary header of h as strategy says.
+func setVary(h http.Header, strategy VaryStrategy) {
+	switch strategy {
+	case VaryMerge:
+		addVary(h, route.HeaderAcceptEncoding)
+	case VaryReplace:
+		h.Set(route.HeaderVary, route.HeaderAcceptEncoding)
 	}
 }
 
-func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return w.ResponseWriter.(http.Hijacker).Hijack()
+// addVary adds field to the Vary header unless it is already listed, possibly
+// as part of a comma-separated value set by other middleware, or Vary is "*".
+func addVary(h http.Header, field string) {
+	for _, v := range h[route.HeaderVary] {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	h.Add(route.HeaderVary, field)
 }
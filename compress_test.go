@@ -1,16 +1,42 @@
 package compress
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/goroute/route"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 )
 
 func TestGzip(t *testing.T) {
@@ -33,11 +59,11 @@ func TestGzip(t *testing.T) {
 
 	// Gzip
 	req = httptest.NewRequest(http.MethodGet, "/", nil)
-	req.Header.Set(route.HeaderAcceptEncoding, gzipScheme)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
 	rec = httptest.NewRecorder()
 	c = mux.NewContext(req, rec)
 	mw(c, h)
-	assert.Equal(gzipScheme, rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
 	assert.Contains(rec.Header().Get(route.HeaderContentType), route.MIMETextPlain)
 	r, err := gzip.NewReader(rec.Body)
 	if assert.NoError(err) {
@@ -50,7 +76,7 @@ func TestGzip(t *testing.T) {
 	// Gzip chunked
 	chunkBuf := make([]byte, 5)
 	req = httptest.NewRequest(http.MethodGet, "/", nil)
-	req.Header.Set(route.HeaderAcceptEncoding, gzipScheme)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
 	rec = httptest.NewRecorder()
 
 	c = mux.NewContext(req, rec)
@@ -64,7 +90,7 @@ func TestGzip(t *testing.T) {
 
 		// Read the first part of the data
 		assert.True(rec.Flushed)
-		assert.Equal(gzipScheme, rec.Header().Get(route.HeaderContentEncoding))
+		assert.Equal(string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
 		r.Reset(rec.Body)
 
 		_, err = io.ReadFull(r, chunkBuf)
@@ -93,7 +119,7 @@ func TestGzip(t *testing.T) {
 func TestGzipNoContent(t *testing.T) {
 	mux := route.NewServeMux()
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	req.Header.Set(route.HeaderAcceptEncoding, gzipScheme)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
 	rec := httptest.NewRecorder()
 	c := mux.NewContext(req, rec)
 	h := func(c route.Context) error {
@@ -114,7 +140,7 @@ func TestGzipErrorReturned(t *testing.T) {
 		return route.ErrNotFound
 	})
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	req.Header.Set(route.HeaderAcceptEncoding, gzipScheme)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
 	rec := httptest.NewRecorder()
 	mux.ServeHTTP(rec, req)
 	assert.Equal(t, http.StatusNotFound, rec.Code)
@@ -126,7 +152,7 @@ func TestGzipWithStatic(t *testing.T) {
 	mux.Use(New())
 	mux.Static("/test", "testdata/images")
 	req := httptest.NewRequest(http.MethodGet, "/test/walle.png", nil)
-	req.Header.Set(route.HeaderAcceptEncoding, gzipScheme)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
 	rec := httptest.NewRecorder()
 	mux.ServeHTTP(rec, req)
 	assert.Equal(t, http.StatusOK, rec.Code)
@@ -146,3 +172,3625 @@ func TestGzipWithStatic(t *testing.T) {
 		}
 	}
 }
+
+func TestGzipETag(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy ETagStrategy
+		etag     string
+		want     string
+	}{
+		{"weaken", ETagWeaken, `"abc"`, `W/"abc"`},
+		{"suffix", ETagSuffix, `"abc"`, `"abc-gzip"`},
+		{"keep", ETagKeep, `"abc"`, `"abc"`},
+		{"already weak", ETagSuffix, `W/"abc"`, `W/"abc"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := route.NewServeMux()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+			rec := httptest.NewRecorder()
+			c := mux.NewContext(req, rec)
+			h := func(c route.Context) error {
+				c.Response().Header().Set(headerETag, tt.etag)
+				return c.String(http.StatusOK, "test")
+			}
+			if assert.NoError(t, New(ETag(tt.strategy))(c, h)) {
+				assert.Equal(t, tt.want, rec.Header().Get(headerETag))
+			}
+		})
+	}
+}
+
+func TestGzipETagSuffixConditional(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	req.Header.Set(headerIfNoneMatch, `"abc-gzip", "def"`)
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		assert.Equal(t, `"abc", "def"`, c.Request().Header.Get(headerIfNoneMatch))
+		return c.NoContent(http.StatusNotModified)
+	}
+	assert.NoError(t, New(ETag(ETagSuffix))(c, h))
+}
+
+func TestGzipComputeETag(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New(ComputeETag(true)))
+	mux.GET("/", func(c route.Context) error {
+		c.Response().Header().Set(headerETag, `"handler"`)
+		return c.String(http.StatusOK, "test")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get(headerETag)
+	assert.NotEqual(t, `"handler"`, etag)
+	assert.NotContains(t, etag, "W/")
+	r, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		buf := new(bytes.Buffer)
+		buf.ReadFrom(r)
+		assert.Equal(t, "test", buf.String())
+	}
+
+	// Revalidation
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	req.Header.Set(headerIfNoneMatch, etag)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Equal(t, etag, rec.Header().Get(headerETag))
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(t, 0, rec.Body.Len())
+}
+
+func TestGzipComputeETagOverflow(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		c.Response().Header().Set(headerETag, `"handler"`)
+		return c.String(http.StatusOK, "test")
+	}
+	if assert.NoError(t, New(ComputeETag(true), MaxBufferSize(8))(c, h)) {
+		assert.Equal(t, `W/"handler"`, rec.Header().Get(headerETag))
+		r, err := gzip.NewReader(rec.Body)
+		if assert.NoError(t, err) {
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(r)
+			assert.Equal(t, "test", buf.String())
+		}
+	}
+}
+
+func TestGzipBuffer(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		c.Response().Write([]byte("test"))
+		c.Response().Write([]byte("test"))
+		return nil
+	}
+	if assert.NoError(t, New(Buffer(true))(c, h)) {
+		assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get(route.HeaderContentLength))
+		r, err := gzip.NewReader(rec.Body)
+		if assert.NoError(t, err) {
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(r)
+			assert.Equal(t, "testtest", buf.String())
+		}
+	}
+
+	// Larger than MaxBufferSize
+	rec = httptest.NewRecorder()
+	c = mux.NewContext(req, rec)
+	if assert.NoError(t, New(Buffer(true), MaxBufferSize(16))(c, h)) {
+		assert.Empty(t, rec.Header().Get(route.HeaderContentLength))
+		r, err := gzip.NewReader(rec.Body)
+		if assert.NoError(t, err) {
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(r)
+			assert.Equal(t, "testtest", buf.String())
+		}
+	}
+}
+
+func TestGzipHead(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New(MinLength(1024), ExcludedContentTypes("image/*"), ETag(ETagSuffix)))
+	// A handler that answers HEAD with the headers of GET and no body, as
+	// http.ServeContent does.
+	handler := func(contentType string, size int) route.HandlerFunc {
+		return func(c route.Context) error {
+			h := c.Response().Header()
+			h.Set(route.HeaderContentType, contentType)
+			h.Set(route.HeaderContentLength, strconv.Itoa(size))
+			h.Set(headerETag, `"v1"`)
+			c.Response().WriteHeader(http.StatusOK)
+			if c.Request().Method == http.MethodHead {
+				return nil
+			}
+			_, err := io.WriteString(c.Response(), strings.Repeat("a", size))
+			return err
+		}
+	}
+	methods := []string{http.MethodGet, http.MethodHead}
+	mux.Match(methods, "/cl", handler(route.MIMETextPlain, 6000))
+	mux.Match(methods, "/short", handler(route.MIMETextPlain, 100))
+	mux.Match(methods, "/image", handler("image/png", 6000))
+	for _, path := range []string{"/cl", "/short", "/image"} {
+		headers := make(map[string]http.Header)
+		for _, method := range methods {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			headers[method] = rec.Header()
+		}
+		assert.Equal(t, headers[http.MethodGet], headers[http.MethodHead], path)
+	}
+}
+
+func TestGzipEmptyBody(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		c.Response().WriteHeader(http.StatusOK)
+		assert.Empty(t, c.Response().Header().Get(route.HeaderContentEncoding))
+		_, err := c.Response().Write(nil)
+		return err
+	}
+	if assert.NoError(t, New()(c, h)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+		assert.Equal(t, 0, rec.Body.Len())
+	}
+}
+
+func TestGzipNotModified(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		h := c.Response().Header()
+		h.Set(headerETag, `"abc"`)
+		h.Set(route.HeaderContentType, route.MIMETextPlain)
+		h.Set(route.HeaderContentLength, "4")
+		return c.NoContent(http.StatusNotModified)
+	}
+	if assert.NoError(t, New()(c, h)) {
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Equal(t, route.HeaderAcceptEncoding, rec.Header().Get(route.HeaderVary))
+		assert.Equal(t, `W/"abc"`, rec.Header().Get(headerETag))
+		assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+		assert.Empty(t, rec.Header().Get(route.HeaderContentType))
+		assert.Empty(t, rec.Header().Get(route.HeaderContentLength))
+		assert.Equal(t, 0, rec.Body.Len())
+	}
+}
+
+func TestGzipBodylessStatuses(t *testing.T) {
+	tests := []struct {
+		code    int
+		options []Option
+	}{
+		{http.StatusNoContent, nil},
+		{http.StatusNotModified, nil},
+		{http.StatusSwitchingProtocols, nil},
+		{http.StatusResetContent, []Option{BodylessStatuses(http.StatusResetContent)}},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code), func(t *testing.T) {
+			mux := route.NewServeMux()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+			rec := httptest.NewRecorder()
+			c := mux.NewContext(req, rec)
+			h := func(c route.Context) error {
+				c.Response().Header().Set(route.HeaderContentType, route.MIMETextPlain)
+				c.Response().WriteHeader(tt.code)
+				c.Response().Flush()
+				return nil
+			}
+			if assert.NoError(t, New(tt.options...)(c, h)) {
+				assert.Equal(t, tt.code, rec.Code)
+				assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+				assert.Empty(t, rec.Header().Get(route.HeaderContentType))
+				assert.Equal(t, 0, rec.Body.Len())
+			}
+		})
+	}
+}
+
+func TestGzipInformational(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/", func(c route.Context) error {
+		c.Response().Header().Set("Link", "</style.css>; rel=preload")
+		c.Response().Writer.WriteHeader(http.StatusEarlyHints)
+		return c.String(http.StatusOK, "test")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	res, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, string(EncodingGzip), res.Header.Get(route.HeaderContentEncoding))
+		r, err := gzip.NewReader(res.Body)
+		if assert.NoError(t, err) {
+			buf := new(bytes.Buffer)
+			buf.ReadFrom(r)
+			assert.Equal(t, "test", buf.String())
+		}
+	}
+}
+
+func TestGzipVary(t *testing.T) {
+	tests := []struct {
+		name  string
+		vary  []string
+		want  []string
+		twice bool
+	}{
+		{"empty", nil, []string{route.HeaderAcceptEncoding}, false},
+		{"installed twice", nil, []string{route.HeaderAcceptEncoding}, true},
+		{"other field", []string{route.HeaderOrigin}, []string{route.HeaderOrigin, route.HeaderAcceptEncoding}, false},
+		{"list", []string{"Origin, accept-encoding"}, []string{"Origin, accept-encoding"}, false},
+		{"star", []string{"*"}, []string{"*"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := route.NewServeMux()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			rec := httptest.NewRecorder()
+			for _, v := range tt.vary {
+				rec.Header().Add(route.HeaderVary, v)
+			}
+			c := mux.NewContext(req, rec)
+			h := func(c route.Context) error {
+				return c.String(http.StatusOK, "test")
+			}
+			mw := New()
+			if tt.twice {
+				inner := h
+				h = func(c route.Context) error {
+					return mw(c, inner)
+				}
+			}
+			if assert.NoError(t, mw(c, h)) {
+				assert.Equal(t, tt.want, rec.Header()[route.HeaderVary])
+			}
+		})
+	}
+}
+
+func TestGzipConditionalVary(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		code     int
+		want     string
+	}{
+		{"compressed", string(EncodingGzip), http.StatusOK, route.HeaderAcceptEncoding},
+		{"not accepted", "", http.StatusOK, route.HeaderAcceptEncoding},
+		{"no content", string(EncodingGzip), http.StatusNoContent, ""},
+		{"not modified", "", http.StatusNotModified, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := route.NewServeMux()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(route.HeaderAcceptEncoding, tt.encoding)
+			rec := httptest.NewRecorder()
+			c := mux.NewContext(req, rec)
+			h := func(c route.Context) error {
+				if tt.code != http.StatusOK {
+					return c.NoContent(tt.code)
+				}
+				return c.String(http.StatusOK, "test")
+			}
+			if assert.NoError(t, New(ConditionalVary(true))(c, h)) {
+				assert.Equal(t, tt.code, rec.Code)
+				assert.Equal(t, tt.want, rec.Header().Get(route.HeaderVary))
+			}
+		})
+	}
+
+	// Skipped responses
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	skipper := func(route.Context) bool { return true }
+	h := func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	}
+	if assert.NoError(t, New(ConditionalVary(true), Skipper(skipper))(c, h)) {
+		assert.Empty(t, rec.Header().Get(route.HeaderVary))
+	}
+}
+
+func TestGzipTrailers(t *testing.T) {
+	for _, buffer := range []bool{false, true} {
+		mux := route.NewServeMux()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		c := mux.NewContext(req, rec)
+		h := func(c route.Context) error {
+			res := c.Response()
+			res.Header().Set(headerTrailer, "X-Checksum")
+			res.WriteHeader(http.StatusOK)
+			res.Header().Set("X-Checksum", "early")
+			res.Write([]byte("test"))
+			res.Header().Set("X-Checksum", "final")
+			res.Header().Set(http.TrailerPrefix+"X-Extra", "extra")
+			return nil
+		}
+		if assert.NoError(t, New(Buffer(buffer))(c, h)) {
+			res := rec.Result()
+			assert.Empty(t, res.Header.Get("X-Checksum"))
+			assert.Empty(t, res.Header.Get(route.HeaderContentLength))
+			r, err := gzip.NewReader(res.Body)
+			if assert.NoError(t, err) {
+				buf := new(bytes.Buffer)
+				buf.ReadFrom(r)
+				assert.Equal(t, "test", buf.String())
+			}
+			assert.Equal(t, "final", res.Trailer.Get("X-Checksum"))
+			assert.Equal(t, "extra", res.Trailer.Get("X-Extra"))
+		}
+	}
+}
+
+func TestGzipDigest(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	}
+	if assert.NoError(t, New(Digest("sha-256", "SHA-512"))(c, h)) {
+		sum256 := sha256.Sum256(rec.Body.Bytes())
+		sum512 := sha512.Sum512(rec.Body.Bytes())
+		want := "sha-256=:" + base64.StdEncoding.EncodeToString(sum256[:]) + ":, " +
+			"sha-512=:" + base64.StdEncoding.EncodeToString(sum512[:]) + ":"
+		assert.Equal(t, want, rec.Header().Get(headerContentDigest))
+		assert.Equal(t, want, rec.Header().Get(headerReprDigest))
+	}
+}
+
+func TestGzipUncompressedLengthHeader(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	h := func(c route.Context) error {
+		return c.String(http.StatusOK, strings.Repeat("test", 100))
+	}
+
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	mw := New(Buffer(true), UncompressedLengthHeader("X-Uncompressed-Content-Length"))
+	if assert.NoError(t, mw(c, h)) {
+		assert.Equal(t, "400", rec.Header().Get("X-Uncompressed-Content-Length"))
+		assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get(route.HeaderContentLength))
+	}
+
+	// Streamed
+	rec = httptest.NewRecorder()
+	c = mux.NewContext(req, rec)
+	mw = New(UncompressedLengthHeader("X-Uncompressed-Content-Length"))
+	if assert.NoError(t, mw(c, h)) {
+		assert.Empty(t, rec.Header().Get("X-Uncompressed-Content-Length"))
+	}
+}
+
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+	closed chan bool
+}
+
+func (r *closeNotifyRecorder) CloseNotify() <-chan bool {
+	return r.closed
+}
+
+func TestGzipCloseNotify(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := &closeNotifyRecorder{httptest.NewRecorder(), make(chan bool, 1)}
+	rec.closed <- true
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		_, ok := c.Response().Writer.(http.CloseNotifier)
+		assert.True(t, ok)
+		assert.True(t, <-c.Response().CloseNotify())
+		return nil
+	}
+	assert.NoError(t, New()(c, h))
+}
+
+func TestGzipUnwrap(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		u, ok := c.Response().Writer.(interface{ Unwrap() http.ResponseWriter })
+		if assert.True(t, ok) {
+			assert.Equal(t, rec, u.Unwrap())
+		}
+		return nil
+	}
+	assert.NoError(t, New()(c, h))
+}
+
+func TestGzipResponseController(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/", func(c route.Context) error {
+		rc := ResponseController(c)
+		if err := rc.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+			return err
+		}
+		if err := rc.SetReadDeadline(time.Now().Add(time.Minute)); err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, "test")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	res, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, string(EncodingGzip), res.Header.Get(route.HeaderContentEncoding))
+	}
+
+	// Unsupported by the underlying writer
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		return ResponseController(c).SetWriteDeadline(time.Now())
+	}
+	assert.True(t, errors.Is(New()(c, h), http.ErrNotSupported))
+}
+
+func TestGzipHijack(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/", func(c route.Context) error {
+		conn, rw, err := c.Response().Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 4\r\nConnection: close\r\n\r\ntest")
+		return rw.Flush()
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	res, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Empty(t, res.Header.Get(route.HeaderContentEncoding))
+		b, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, "test", string(b))
+	}
+
+	// Unsupported by the underlying writer
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		c.Response().Write([]byte("test"))
+		_, _, err := c.Response().Hijack()
+		return err
+	}
+	assert.Equal(t, ErrHijackNotSupported, New()(c, h))
+}
+
+func TestGzipPanic(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		c.Response().Write([]byte("test"))
+		panic("test")
+	}
+	assert.PanicsWithValue(t, "test", func() {
+		New(Buffer(true))(c, h)
+	})
+	assert.Equal(t, rec, c.Response().Writer)
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(t, 0, rec.Body.Len())
+}
+
+func TestGzipHandlerError(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []Option
+		check   func(t *testing.T, rec *httptest.ResponseRecorder)
+	}{
+		{"buffered", []Option{Buffer(true)}, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			assert.Equal(t, http.StatusInternalServerError, rec.Code)
+			assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+			// The headers of the response dropped are not sent with the
+			// error.
+			assert.Empty(t, rec.Header().Get(headerCacheControl))
+			assert.Empty(t, rec.Header().Get(headerETag))
+			assert.Equal(t, route.MIMEApplicationJSONCharsetUTF8, rec.Header().Get(route.HeaderContentType))
+			assert.Equal(t, route.HeaderAcceptEncoding, rec.Header().Get(route.HeaderVary))
+			assert.Contains(t, rec.Body.String(), http.StatusText(http.StatusInternalServerError))
+		}},
+		{"streamed", nil, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			r, err := gzip.NewReader(rec.Body)
+			if assert.NoError(t, err) {
+				b, err := ioutil.ReadAll(r)
+				assert.NoError(t, err)
+				assert.Equal(t, "partial", string(b))
+			}
+		}},
+		{"truncated", []Option{AbortOnError(true)}, func(t *testing.T, rec *httptest.ResponseRecorder) {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			r, err := gzip.NewReader(rec.Body)
+			if assert.NoError(t, err) {
+				b, err := ioutil.ReadAll(r)
+				assert.Equal(t, io.ErrUnexpectedEOF, err)
+				assert.Equal(t, "partial", string(b))
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := route.NewServeMux()
+			mux.Use(New(tt.options...))
+			mux.GET("/", func(c route.Context) error {
+				h := c.Response().Header()
+				h.Set(headerCacheControl, "public, max-age=3600")
+				h.Set(headerETag, `W/"v1"`)
+				h.Set(route.HeaderContentType, route.MIMETextPlain)
+				c.Response().Write([]byte("partial"))
+				return errors.New("test")
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			tt.check(t, rec)
+		})
+	}
+}
+
+func TestGzipClientGone(t *testing.T) {
+	mux := route.NewServeMux()
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := func(c route.Context) error {
+		_, err := c.Response().Write([]byte("test"))
+		assert.NoError(t, err)
+		c.Response().Flush()
+		n := rec.Body.Len()
+
+		cancel()
+		_, err = c.Response().Write([]byte("test"))
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.Equal(t, n, rec.Body.Len())
+		return nil
+	}
+	err := New()(c, h)
+	assert.True(t, errors.Is(err, context.Canceled))
+	var e *Error
+	if assert.True(t, errors.As(err, &e)) {
+		assert.Equal(t, OpWrite, e.Op)
+		assert.True(t, e.Client)
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		// No trailer is written for a client that went away.
+		_, err = ioutil.ReadAll(r)
+		assert.Equal(t, io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestGzipHTTP2(t *testing.T) {
+	h := func(c route.Context) error {
+		c.Response().Header().Set(headerTransferEncoding, "chunked")
+		c.Response().Header().Set(route.HeaderContentLength, "4")
+		return c.String(http.StatusOK, "test")
+	}
+	for _, buffer := range []bool{true, false} {
+		mux := route.NewServeMux()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.ProtoMajor, req.ProtoMinor, req.Proto = 2, 0, "HTTP/2.0"
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		c := mux.NewContext(req, rec)
+		if assert.NoError(t, New(HTTP2Buffer(buffer))(c, h)) {
+			assert.Empty(t, rec.Header().Get(headerTransferEncoding))
+			if buffer {
+				assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get(route.HeaderContentLength))
+			} else {
+				assert.Empty(t, rec.Header().Get(route.HeaderContentLength))
+			}
+		}
+	}
+
+	// Responses to HTTP/2 requests stream by default.
+	assert.False(t, GetDefaultOptions().HTTP2Buffer)
+}
+
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	calls int
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.calls++
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestGzipReadFrom(t *testing.T) {
+	files := http.FileServer(http.FS(fstest.MapFS{
+		"test.txt": {Data: []byte(strings.Repeat("test", 100))},
+	}))
+	serve := func(h http.Handler, accept string) *readFromRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/test.txt", nil)
+		if accept != "" {
+			req.Header.Set(route.HeaderAcceptEncoding, accept)
+		}
+		rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Not compressed
+	rec := serve(Wrap(files, ConditionalVary(true)), "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, rec.calls)
+	assert.Equal(t, strings.Repeat("test", 100), rec.Body.String())
+	assert.Equal(t, route.HeaderAcceptEncoding, rec.Header().Get(route.HeaderVary))
+
+	// Compressed
+	rec = serve(Wrap(files), string(EncodingGzip))
+	assert.Equal(t, 0, rec.calls)
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	r, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		b, _ := ioutil.ReadAll(r)
+		assert.Equal(t, strings.Repeat("test", 100), string(b))
+	}
+}
+
+func TestGzipUpgrade(t *testing.T) {
+	mux := route.NewServeMux()
+	h := func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	}
+
+	// Upgrade request
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	req.Header.Set(headerConnection, "keep-alive, Upgrade")
+	req.Header.Set(route.HeaderUpgrade, "h2c")
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	if assert.NoError(t, New()(c, h)) {
+		assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+		assert.Equal(t, "test", rec.Body.String())
+	}
+
+	// Upgrade response
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec = httptest.NewRecorder()
+	c = mux.NewContext(req, rec)
+	h = func(c route.Context) error {
+		c.Response().Header().Set(headerConnection, "Upgrade")
+		c.Response().Header().Set(route.HeaderUpgrade, "custom")
+		return c.String(http.StatusOK, "test")
+	}
+	if assert.NoError(t, New()(c, h)) {
+		assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+		assert.Equal(t, "test", rec.Body.String())
+	}
+}
+
+func TestGzipHandlerContentLength(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	h := func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentLength, "400")
+		return c.String(http.StatusOK, strings.Repeat("test", 100))
+	}
+	for _, buffer := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		c := mux.NewContext(req, rec)
+		mw := New(Buffer(buffer), UncompressedLengthHeader("X-Uncompressed-Content-Length"))
+		if assert.NoError(t, mw(c, h)) {
+			assert.Equal(t, "400", rec.Header().Get("X-Uncompressed-Content-Length"))
+			if buffer {
+				assert.Equal(t, strconv.Itoa(rec.Body.Len()), rec.Header().Get(route.HeaderContentLength))
+			} else {
+				assert.Empty(t, rec.Header().Get(route.HeaderContentLength))
+			}
+		}
+	}
+
+	// Body longer than declared
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h = func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentLength, "4")
+		return c.String(http.StatusOK, "test test")
+	}
+	assert.Equal(t, http.ErrContentLength, New()(c, h))
+}
+
+func TestGzipStatsTrailers(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	h := func(c route.Context) error {
+		return c.String(http.StatusOK, strings.Repeat("test", 100))
+	}
+
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	if assert.NoError(t, New(StatsTrailers(true))(c, h)) {
+		res := rec.Result()
+		assert.Empty(t, res.Header.Get(HeaderOriginalLength))
+		ioutil.ReadAll(res.Body)
+		assert.Equal(t, "400", res.Trailer.Get(HeaderOriginalLength))
+		ratio := strconv.FormatFloat(float64(rec.Body.Len())/400, 'f', 3, 64)
+		assert.Equal(t, ratio, res.Trailer.Get(HeaderCompressionRatio))
+	}
+
+	// Buffered
+	rec = httptest.NewRecorder()
+	c = mux.NewContext(req, rec)
+	if assert.NoError(t, New(StatsTrailers(true), Buffer(true))(c, h)) {
+		res := rec.Result()
+		assert.Empty(t, res.Header.Get(headerTrailer))
+		assert.Equal(t, "400", res.Header.Get(HeaderOriginalLength))
+		assert.NotEmpty(t, res.Header.Get(HeaderCompressionRatio))
+		assert.NotEmpty(t, res.Header.Get(route.HeaderContentLength))
+	}
+}
+
+type unwrapRecorder struct {
+	http.ResponseWriter
+}
+
+func (w *unwrapRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestGzipDoubleWrap(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New())
+	g := mux.Group("/api")
+	g.Use(func(c route.Context, next route.HandlerFunc) error {
+		// Another middleware wrapping the writer in between.
+		c.Response().Writer = &unwrapRecorder{c.Response().Writer}
+		return next(c)
+	})
+	g.Use(New())
+	g.GET("/test", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	r, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", string(b))
+	}
+}
+
+type failingRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r *failingRecorder) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestGzipWriteError(t *testing.T) {
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := &failingRecorder{httptest.NewRecorder()}
+	c := mux.NewContext(req, rec)
+	var reported error
+	h := func(c route.Context) error {
+		c.Response().Write([]byte("test"))
+		assert.Error(t, ResponseController(c).Flush())
+		return nil
+	}
+	mw := New(OnError(func(c route.Context, err error) {
+		reported = err
+	}))
+	err := mw(c, h)
+	assert.EqualError(t, err, "compress: write: broken pipe")
+	assert.Equal(t, err, reported)
+	var e *Error
+	if assert.True(t, errors.As(err, &e)) {
+		assert.Equal(t, OpWrite, e.Op)
+		assert.True(t, e.Client)
+	}
+}
+
+func TestGzipStats(t *testing.T) {
+	mux := route.NewServeMux()
+	body := strings.Repeat("test", 100)
+	h := func(c route.Context) error {
+		return c.String(http.StatusOK, body)
+	}
+
+	// Compressed
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	assert.NoError(t, New(Level(gzip.BestSpeed))(c, h))
+	s, ok := GetStats(c)
+	assert.True(t, ok)
+	assert.Equal(t, EncodingGzip, s.Encoding)
+	assert.Equal(t, gzip.BestSpeed, s.Level)
+	assert.Equal(t, int64(len(body)), s.UncompressedSize)
+	assert.Equal(t, int64(rec.Body.Len()), s.CompressedSize)
+	assert.True(t, s.Duration > 0)
+	assert.Equal(t, int64(len(body)), c.Response().Size)
+	assert.Equal(t, EncodingGzip, c.Get(EncodingKey))
+	assert.Equal(t, float64(s.CompressedSize)/float64(s.UncompressedSize), c.Get(RatioKey))
+	assert.Equal(t, s.Duration, c.Get(DurationKey))
+
+	// Not accepted
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+	c = mux.NewContext(req, rec)
+	assert.NoError(t, New()(c, h))
+	s, ok = GetStats(c)
+	assert.True(t, ok)
+	assert.Equal(t, Stats{UncompressedSize: int64(len(body)), CompressedSize: int64(len(body)), ContentType: route.MIMETextPlain}, s)
+	assert.Equal(t, EncodingIdentity, c.Get(EncodingKey))
+	assert.Equal(t, 1.0, c.Get(RatioKey))
+
+	// Passed through
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	rec = httptest.NewRecorder()
+	c = mux.NewContext(req, rec)
+	assert.NoError(t, New(ConditionalVary(true))(c, h))
+	s, _ = GetStats(c)
+	assert.Equal(t, Stats{UncompressedSize: int64(len(body)), CompressedSize: int64(len(body)), ContentType: route.MIMETextPlain}, s)
+}
+
+func TestGzipCollector(t *testing.T) {
+	collector := NewCollector()
+	mux := route.NewServeMux()
+	mux.Use(New(Collect(collector)))
+	mux.GET("/text", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	mux.GET("/empty", func(c route.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})
+	for _, path := range []string{"/text", "/empty", "/text"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/text", nil))
+
+	s := collector.Stats()
+	assert.Equal(t, int64(4), s.Requests)
+	assert.Equal(t, int64(2), s.Compressed)
+	assert.Equal(t, map[Encoding]int64{EncodingGzip: 2}, s.Encodings)
+	assert.Equal(t, map[SkipReason]int64{SkipNoBody: 1, SkipNotAccepted: 1}, s.Skipped)
+	assert.Equal(t, int64(12), s.BytesIn)
+	assert.True(t, s.BytesOut > s.BytesIn)
+	if h := s.Durations[EncodingGzip]["text"]; assert.Len(t, h.Counts, len(h.Bounds)+1) {
+		assert.Equal(t, int64(2), h.Count)
+	}
+	if h := s.Ratios[EncodingGzip]["text"]; assert.Equal(t, int64(2), h.Count) {
+		// Tiny bodies grow when compressed.
+		assert.Equal(t, int64(2), h.Counts[len(h.Counts)-1])
+	}
+	assert.Equal(t, "not_accepted", SkipNotAccepted.String())
+}
+
+// expvars counts the expvar names published by tests.
+var expvars atomic.Int32
+
+// expvarName returns an expvar name unique to the run of t, as expvar names
+// cannot be published twice, for example with -count.
+func expvarName(t *testing.T) string {
+	return fmt.Sprintf("%s_%d", t.Name(), expvars.Add(1))
+}
+
+func TestGzipExpvar(t *testing.T) {
+	name := expvarName(t)
+	mux := route.NewServeMux()
+	mux.Use(New(Expvar(name)))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	v := expvar.Get(name)
+	if assert.NotNil(t, v) {
+		assert.Equal(t, `{"requests":1,"compressed":0,"skipped":{"not_accepted":1},"encodings":{},"bytes_in":4,"bytes_out":4,"anomalies":0,"durations":{},"ratios":{}}`, v.String())
+	}
+}
+
+func TestGzipOnComplete(t *testing.T) {
+	var stats []Stats
+	mux := route.NewServeMux()
+	mux.Use(New(OnComplete(func(c route.Context, s Stats) {
+		stats = append(stats, s)
+	})))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if assert.Len(t, stats, 2) {
+		assert.Equal(t, EncodingGzip, stats[0].Encoding)
+		assert.Equal(t, int64(4), stats[0].UncompressedSize)
+		assert.Equal(t, int64(rec.Body.Len()), stats[0].CompressedSize)
+		assert.Equal(t, Stats{UncompressedSize: 4, CompressedSize: 4, ContentType: route.MIMETextPlain}, stats[1])
+	}
+}
+
+func TestGzipSkip(t *testing.T) {
+	mux := route.NewServeMux()
+	var reason SkipReason
+	mux.Use(New(
+		MinLength(10),
+		ExcludedContentTypes("image/*", "application/zip"),
+		OnSkip(func(c route.Context, r SkipReason) {
+			reason = r
+		}),
+	))
+	mux.GET("/short", func(c route.Context) error {
+		c.Response().Write([]byte("te"))
+		c.Response().Write([]byte("st"))
+		return nil
+	})
+	mux.GET("/long", func(c route.Context) error {
+		c.Response().Write([]byte("test"))
+		c.Response().Write([]byte("testtest"))
+		return nil
+	})
+	mux.GET("/length", func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentLength, "4")
+		return c.String(http.StatusOK, "test")
+	})
+	mux.GET("/image", func(c route.Context) error {
+		return c.Blob(http.StatusOK, "image/png", bytes.Repeat([]byte("test"), 10))
+	})
+	mux.GET("/zip", func(c route.Context) error {
+		return c.Blob(http.StatusOK, "application/zip", bytes.Repeat([]byte("test"), 10))
+	})
+	mux.GET("/no-transform", func(c route.Context) error {
+		c.Response().Header().Set("Cache-Control", "public, no-transform")
+		return c.String(http.StatusOK, strings.Repeat("test", 10))
+	})
+	mux.GET("/encoded", func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentEncoding, "br")
+		return c.String(http.StatusOK, strings.Repeat("test", 10))
+	})
+
+	for path, want := range map[string]SkipReason{
+		"/short":        SkipBelowMinLength,
+		"/length":       SkipBelowMinLength,
+		"/image":        SkipExcludedContentType,
+		"/zip":          SkipExcludedContentType,
+		"/no-transform": SkipNoTransform,
+		"/encoded":      SkipAlreadyEncoded,
+	} {
+		reason = 0
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, want, reason, path)
+		if want != SkipAlreadyEncoded {
+			assert.Equal(t, "", rec.Header().Get(route.HeaderContentEncoding), path)
+		}
+	}
+
+	// Short body held back, then passed through.
+	req := httptest.NewRequest(http.MethodGet, "/short", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, "test", rec.Body.String())
+
+	// Long enough once the second write arrives.
+	reason = 0
+	req = httptest.NewRequest(http.MethodGet, "/long", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, SkipReason(0), reason)
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	r, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "testtesttest", string(b))
+	}
+
+	// Not accepted
+	req = httptest.NewRequest(http.MethodGet, "/long", nil)
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, SkipNotAccepted, reason)
+}
+
+func TestGzipDebugHeader(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New(DebugHeader(true), Level(gzip.BestSpeed), MinLength(5)))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, strings.Repeat("test", 100))
+	})
+	mux.GET("/stream", func(c route.Context) error {
+		c.Response().Write([]byte(strings.Repeat("test", 100)))
+		c.Response().Flush()
+		return nil
+	})
+	mux.GET("/short", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+
+	// Buffered
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	h := New(DebugHeader(true), Level(gzip.BestSpeed), Buffer(true))
+	assert.NoError(t, h(c, func(c route.Context) error {
+		return c.String(http.StatusOK, strings.Repeat("test", 100))
+	}))
+	assert.Regexp(t, `^gzip;level=1;ratio=0\.\d\d;dur=\d+\.\dms$`, rec.Header().Get(HeaderCompress))
+
+	// Streamed
+	req = httptest.NewRequest(http.MethodGet, "/stream", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, HeaderCompress, rec.Header().Get(headerTrailer))
+	assert.Regexp(t, `^gzip;level=1;ratio=`, rec.Result().Trailer.Get(HeaderCompress))
+
+	// Skipped
+	req = httptest.NewRequest(http.MethodGet, "/short", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, "identity;reason=below_min_length", rec.Header().Get(HeaderCompress))
+
+	// Not accepted
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "identity;reason=not_accepted", rec.Header().Get(HeaderCompress))
+}
+
+func TestGzipLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	mux := route.NewServeMux()
+	mux.Use(New(Logger(logger)))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Contains(t, buf.String(), `level=DEBUG msg="compress: response not compressed" path=/ reason=not_accepted`)
+
+	buf.Reset()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	c := mux.NewContext(req, &failingRecorder{httptest.NewRecorder()})
+	New(Logger(logger))(c, func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	assert.Contains(t, buf.String(), `level=DEBUG msg="compress: response failed" path=/ error="compress: write: broken pipe"`)
+}
+
+func TestGzipStatsHandler(t *testing.T) {
+	collector := NewCollector()
+	mux := route.NewServeMux()
+	mux.GET("/stats", StatsHandler(collector))
+	g := mux.Group("/api")
+	g.Use(New(Collect(collector)))
+	g.GET("/test", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/test", nil))
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	var s Counters
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &s)) {
+		assert.Equal(t, int64(1), s.Requests)
+		assert.Equal(t, map[SkipReason]int64{SkipNotAccepted: 1}, s.Skipped)
+		assert.Equal(t, int64(4), s.BytesIn)
+	}
+}
+
+func TestGzipShadow(t *testing.T) {
+	body := strings.Repeat("test", 100)
+	var stats []Stats
+	mux := route.NewServeMux()
+	mux.Use(New(Shadow(true), MinLength(10), OnComplete(func(c route.Context, s Stats) {
+		stats = append(stats, s)
+	})))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, body)
+	})
+	mux.GET("/short", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, "", rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(t, "", rec.Header().Get(route.HeaderVary))
+	assert.Equal(t, body, rec.Body.String())
+	if assert.Len(t, stats, 1) {
+		assert.True(t, stats[0].Shadow)
+		assert.Equal(t, EncodingGzip, stats[0].Encoding)
+		assert.Equal(t, int64(len(body)), stats[0].UncompressedSize)
+		assert.True(t, stats[0].CompressedSize < stats[0].UncompressedSize)
+	}
+
+	// Below MinLength
+	req = httptest.NewRequest(http.MethodGet, "/short", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, "test", rec.Body.String())
+	if assert.Len(t, stats, 2) {
+		assert.Equal(t, Stats{UncompressedSize: 4, CompressedSize: 4, ContentType: route.MIMETextPlain}, stats[1])
+	}
+
+	// Not sampled
+	var reason SkipReason
+	h := New(Shadow(true), ShadowRate(0), OnSkip(func(c route.Context, r SkipReason) {
+		reason = r
+	}))
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	c := mux.NewContext(req, httptest.NewRecorder())
+	assert.NoError(t, h(c, func(c route.Context) error {
+		return c.String(http.StatusOK, body)
+	}))
+	assert.Equal(t, SkipNotSampled, reason)
+}
+
+func TestGzipNegotiation(t *testing.T) {
+	for v, want := range map[string]bool{
+		"gzip":                 true,
+		"GZIP":                 true,
+		"deflate, gzip;q=0.5":  true,
+		"x-gzip":               true,
+		"gzip;q=0":             false,
+		"*":                    true,
+		"*;q=0":                false,
+		"gzip;q=0, *":          false,
+		"br, *;q=0.1":          true,
+		"deflate":              false,
+		"identity, gzipfoo":    false,
+		"gzip;level=1;q=0.001": true,
+	} {
+		assert.Equal(t, want, accepts(parseAcceptEncoding(v, nil), EncodingGzip), v)
+	}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	mux := route.NewServeMux()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add(route.HeaderAcceptEncoding, "br;q=1.0")
+	req.Header.Add(route.HeaderAcceptEncoding, "gzip;q=0.8")
+	c := mux.NewContext(req, httptest.NewRecorder())
+	New(Logger(logger), NegotiationLogRate(1))(c, func(c route.Context) error {
+		return nil
+	})
+	assert.Contains(t, buf.String(), `msg="compress: negotiated content coding" path=/ accept_encoding="br;q=1.0,gzip;q=0.8" parsed="[br;q=1 gzip;q=0.8]" chosen=gzip`)
+}
+
+func TestGzipSkipReasonKey(t *testing.T) {
+	mux := route.NewServeMux()
+	h := func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	c := mux.NewContext(req, httptest.NewRecorder())
+	assert.NoError(t, New()(c, h))
+	reason, ok := GetSkipReason(c)
+	assert.True(t, ok)
+	assert.Equal(t, SkipReason(0), reason)
+
+	c = mux.NewContext(req, httptest.NewRecorder())
+	assert.NoError(t, New(ExcludedContentTypes("text/plain"))(c, h))
+	reason, _ = GetSkipReason(c)
+	assert.Equal(t, SkipExcludedContentType, reason)
+
+	c = mux.NewContext(req, httptest.NewRecorder())
+	_, ok = GetSkipReason(c)
+	assert.False(t, ok)
+}
+
+func TestGzipBREACH(t *testing.T) {
+	mux := route.NewServeMux()
+	h := func(c route.Context) error {
+		switch c.Request().URL.Path {
+		case "/login":
+			c.SetCookie(&http.Cookie{Name: "session", Value: "secret"})
+		case "/token":
+			MarkSensitive(c)
+		}
+		return c.String(http.StatusOK, "test")
+	}
+	mw := New(SkipAuthenticated(true), SkipSetCookie(true), Sensitive(func(c route.Context) bool {
+		return c.Request().URL.Path == "/account"
+	}))
+	for _, tc := range []struct {
+		path, header string
+		want         SkipReason
+	}{
+		{"/", "", 0},
+		{"/", route.HeaderAuthorization, SkipCredentials},
+		{"/", "Cookie", SkipCredentials},
+		{"/account", "", SkipSensitive},
+		{"/login", "", SkipResponseCookies},
+		{"/token", "", SkipSensitive},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		if tc.header != "" {
+			req.Header.Set(tc.header, "secret")
+		}
+		rec := httptest.NewRecorder()
+		c := mux.NewContext(req, rec)
+		assert.NoError(t, mw(c, h))
+		reason, _ := GetSkipReason(c)
+		assert.Equal(t, tc.want, reason, tc.header)
+		if tc.want != 0 {
+			assert.Equal(t, "test", rec.Body.String())
+		}
+	}
+}
+
+func TestGzipPadding(t *testing.T) {
+	mux := route.NewServeMux()
+	mw := New(GzipPadding(32))
+	names := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		c := mux.NewContext(req, rec)
+		assert.NoError(t, mw(c, func(c route.Context) error {
+			return c.String(http.StatusOK, "test")
+		}))
+		r, err := gzip.NewReader(rec.Body)
+		if assert.NoError(t, err) {
+			assert.True(t, len(r.Name) >= 1 && len(r.Name) <= 32)
+			names[r.Name] = true
+			b, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "test", string(b))
+		}
+	}
+	assert.True(t, len(names) > 1)
+}
+
+func TestGzipLengthPadding(t *testing.T) {
+	mux := route.NewServeMux()
+	body := strings.Repeat("test", 100)
+
+	// Buffered
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(req, rec)
+	assert.NoError(t, New(LengthPadding(64), Buffer(true))(c, func(c route.Context) error {
+		return c.String(http.StatusOK, body)
+	}))
+	padding := rec.Header().Get(HeaderPadding)
+	assert.NotEmpty(t, padding)
+	assert.Equal(t, 0, (rec.Body.Len()+len(padding))%64)
+
+	// Streamed
+	rec = httptest.NewRecorder()
+	c = mux.NewContext(req, rec)
+	assert.NoError(t, New(LengthPadding(64))(c, func(c route.Context) error {
+		return c.String(http.StatusOK, body)
+	}))
+	assert.Equal(t, HeaderPadding, rec.Header().Get(headerTrailer))
+	padding = rec.Result().Trailer.Get(HeaderPadding)
+	assert.NotEmpty(t, padding)
+	assert.Equal(t, 0, (rec.Body.Len()+len(padding))%64)
+}
+
+func TestGzipCrossOrigin(t *testing.T) {
+	mux := route.NewServeMux()
+	mw := New(SkipCrossOrigin(true))
+	for _, tc := range []struct {
+		header http.Header
+		want   SkipReason
+	}{
+		{http.Header{"Cookie": {"a=b"}}, 0},
+		{http.Header{"Cookie": {"a=b"}, "Origin": {"http://example.com"}}, 0},
+		{http.Header{"Origin": {"http://attacker.com"}}, 0},
+		{http.Header{"Cookie": {"a=b"}, "Origin": {"http://attacker.com"}}, SkipCrossSite},
+		{http.Header{"Cookie": {"a=b"}, "Origin": {"https://example.com"}}, SkipCrossSite},
+		{http.Header{"Authorization": {"Bearer x"}, "Origin": {"null"}}, SkipCrossSite},
+		{http.Header{"Cookie": {"a=b"}, "Sec-Fetch-Site": {"same-origin"}}, 0},
+		{http.Header{"Cookie": {"a=b"}, "Sec-Fetch-Site": {"cross-site"}}, SkipCrossSite},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		for k, v := range tc.header {
+			req.Header[k] = v
+		}
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		c := mux.NewContext(req, httptest.NewRecorder())
+		assert.NoError(t, mw(c, func(c route.Context) error {
+			return c.String(http.StatusOK, "test")
+		}))
+		reason, _ := GetSkipReason(c)
+		assert.Equal(t, tc.want, reason, tc.header)
+	}
+}
+
+func TestGzipLimiter(t *testing.T) {
+	mux := route.NewServeMux()
+	mw := New(Limit(NewLimiter(1, 100)))
+	h := func(c route.Context) error {
+		return c.String(http.StatusOK, strings.Repeat("test", 20))
+	}
+	var reasons []SkipReason
+	for _, addr := range []string{"192.0.2.1:1234", "192.0.2.1:1235", "192.0.2.1:1236", "192.0.2.2:1234"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = addr
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		c := mux.NewContext(req, rec)
+		assert.NoError(t, mw(c, h))
+		reason, _ := GetSkipReason(c)
+		reasons = append(reasons, reason)
+	}
+	// The first client has budget left after one response, but not after
+	// two. The second one is unaffected.
+	assert.Equal(t, []SkipReason{0, 0, SkipRateLimited, 0}, reasons)
+}
+
+func TestGzipAnomaly(t *testing.T) {
+	collector := NewCollector()
+	var flagged []float64
+	mux := route.NewServeMux()
+	mux.Use(New(Collect(collector), AnomalyFactor(3), OnAnomaly(func(c route.Context, s Stats, baseline float64) {
+		flagged = append(flagged, baseline)
+	})))
+	random := make([]byte, 4000)
+	crand.Read(random)
+	mux.GET("/data", func(c route.Context) error {
+		if c.QueryParam("leak") != "" {
+			return c.Blob(http.StatusOK, route.MIMEOctetStream, random)
+		}
+		return c.Blob(http.StatusOK, route.MIMEOctetStream, bytes.Repeat([]byte("test"), 1000))
+	})
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/data", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Empty(t, flagged)
+
+	req := httptest.NewRequest(http.MethodGet, "/data?leak=1", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	if assert.Len(t, flagged, 1) {
+		assert.True(t, flagged[0] < 0.1)
+	}
+	assert.Equal(t, int64(1), collector.Stats().Anomalies)
+
+	// Paths chosen by clients cannot grow the baselines without bound, and
+	// trusted baselines survive them.
+	d := newDetector(3)
+	for i := 0; i < anomalyWarmup; i++ {
+		d.observe("/data", 0.1)
+	}
+	for i := 0; i < 3*maxBaselines; i++ {
+		d.observe(fmt.Sprintf("/data/%d", i), 0.1)
+		if !assert.True(t, len(d.baselines) <= maxBaselines) {
+			return
+		}
+	}
+	_, anomalous := d.observe("/data", 0.9)
+	assert.True(t, anomalous)
+}
+
+func TestGzipNewWithOptions(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.Level = gzip.BestSpeed
+	opts.Skipper = nil
+	mw, err := NewWithOptions(opts)
+	if assert.NoError(t, err) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		c := route.NewServeMux().NewContext(req, httptest.NewRecorder())
+		assert.NoError(t, mw(c, func(c route.Context) error {
+			return c.String(http.StatusOK, "test")
+		}))
+		s, _ := GetStats(c)
+		assert.Equal(t, gzip.BestSpeed, s.Level)
+	}
+
+	opts.Level = 42
+	_, err = NewWithOptions(opts)
+	assert.EqualError(t, err, "compress: invalid compression level: 42")
+}
+
+func TestGzipValidate(t *testing.T) {
+	for _, tc := range []struct {
+		option Option
+		err    error
+	}{
+		{Level(gzip.BestCompression + 1), ErrInvalidLevel},
+		{MinLength(-1), ErrInvalidOption},
+		{ShadowRate(2), ErrInvalidOption},
+		{AnomalyFactor(0.5), ErrInvalidOption},
+		{Digest("md5"), ErrUnknownDigest},
+		{func(o *Options) {
+			o.Shadow = true
+			o.Buffer = true
+		}, ErrConflictingOptions},
+		{func(o *Options) {
+			o.ComputeETag = true
+			o.GzipPadding = 32
+		}, ErrConflictingOptions},
+	} {
+		opts := GetDefaultOptions()
+		tc.option(&opts)
+		err := opts.Validate()
+		assert.True(t, errors.Is(err, tc.err), "%v", err)
+		assert.Panics(t, func() {
+			New(tc.option)
+		})
+	}
+	assert.NoError(t, GetDefaultOptions().Validate())
+}
+
+func TestGzipOptionsJSON(t *testing.T) {
+	opts := Options{
+		Level:                gzip.BestSpeed,
+		ETag:                 ETagSuffix,
+		Digest:               []string{"sha-256"},
+		MinLength:            256,
+		ExcludedContentTypes: []string{"image/*"},
+		BodylessStatuses:     []int{http.StatusNoContent},
+		ShadowRate:           0.5,
+	}
+	b, err := json.Marshal(opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(b), `"etag":"suffix"`)
+	assert.Contains(t, string(b), `"min_length":256`)
+
+	var decoded Options
+	if assert.NoError(t, json.Unmarshal(b, &decoded)) {
+		assert.Equal(t, opts, decoded)
+	}
+
+	// Unset fields keep the defaults of the value decoded into.
+	decoded = GetDefaultOptions()
+	if assert.NoError(t, json.Unmarshal([]byte(`{"level":9,"etag":"keep"}`), &decoded)) {
+		assert.Equal(t, gzip.BestCompression, decoded.Level)
+		assert.Equal(t, ETagKeep, decoded.ETag)
+		assert.Equal(t, 1<<20, decoded.MaxBufferSize)
+		assert.NotNil(t, decoded.Skipper)
+	}
+	assert.Error(t, json.Unmarshal([]byte(`{"etag":"strip"}`), &decoded))
+}
+
+func TestGzipOptionsYAML(t *testing.T) {
+	host := GetDefaultOptions()
+	host.Level = gzip.BestSpeed
+	host.ETag = ETagKeep
+	host.Vary = VarySkip
+	opts := Options{
+		Level:                    gzip.BestCompression,
+		ETag:                     ETagSuffix,
+		ComputeETag:              true,
+		Buffer:                   true,
+		Digest:                   []string{"sha-256"},
+		UncompressedLengthHeader: "X-Length",
+		HTTP2Buffer:              true,
+		StatsTrailers:            true,
+		DebugHeader:              true,
+		MaxBufferSize:            1 << 16,
+		FlushInterval:            100 * time.Millisecond,
+		FlushEvents:              true,
+		FlushRecords:             true,
+		FlushPolicies:            map[string]FlushStrategy{"text/html": FlushNone},
+		MinLength:                256,
+		ExcludedContentTypes:     []string{"image/*"},
+		SniffLength:              1024,
+		SkipAuthenticated:        true,
+		SkipSetCookie:            true,
+		SkipCrossOrigin:          true,
+		LengthPadding:            32,
+		BodylessStatuses:         []int{http.StatusNoContent},
+		AbortOnError:             true,
+		ConditionalVary:          true,
+		Vary:                     VaryReplace,
+		AnomalyFactor:            2,
+		NegotiationLogRate:       0.1,
+		Aliases:                  map[string]Encoding{"x-gzip": EncodingGzip},
+		ShadowRate:               0.5,
+		RolloutPercent:           50,
+		Expvar:                   "compress",
+		Disabled:                 true,
+		Edge:                     true,
+		Transcode:                true,
+		PerHost:                  HostOptions{"example.com": host},
+	}
+	b, err := yaml.Marshal(opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(b), "etag: suffix")
+	assert.Contains(t, string(b), "vary: replace")
+	assert.Contains(t, string(b), "flush_interval: 100ms")
+
+	var decoded Options
+	if assert.NoError(t, yaml.Unmarshal(b, &decoded)) {
+		again, err := yaml.Marshal(decoded)
+		assert.NoError(t, err)
+		assert.Equal(t, string(b), string(again))
+		// The entry starts from the defaults, functions included.
+		entry := decoded.PerHost["example.com"]
+		assert.Equal(t, gzip.BestSpeed, entry.Level)
+		assert.Equal(t, ETagKeep, entry.ETag)
+		assert.Equal(t, VarySkip, entry.Vary)
+		assert.NotNil(t, entry.Skipper)
+		decoded.PerHost, opts.PerHost = nil, nil
+		assert.Equal(t, opts, decoded)
+	}
+
+	// Unset fields keep the defaults of the value decoded into.
+	decoded = GetDefaultOptions()
+	if assert.NoError(t, yaml.Unmarshal([]byte("level: 9\netag: keep\nvary: skip\n"), &decoded)) {
+		assert.Equal(t, gzip.BestCompression, decoded.Level)
+		assert.Equal(t, ETagKeep, decoded.ETag)
+		assert.Equal(t, VarySkip, decoded.Vary)
+		assert.Equal(t, 1<<20, decoded.MaxBufferSize)
+		assert.NotNil(t, decoded.Skipper)
+	}
+	assert.Error(t, yaml.Unmarshal([]byte("etag: strip\n"), &decoded))
+	assert.Error(t, yaml.Unmarshal([]byte("vary: always\n"), &decoded))
+}
+
+func TestGzipOptionsFromEnv(t *testing.T) {
+	t.Setenv("COMPRESS_LEVEL", "9")
+	t.Setenv("COMPRESS_MIN_LENGTH", "1024")
+	t.Setenv("COMPRESS_ETAG", "suffix")
+	t.Setenv("COMPRESS_SKIP_SET_COOKIE", "true")
+	t.Setenv("COMPRESS_SHADOW_RATE", "0.25")
+	t.Setenv("COMPRESS_EXCLUDED_CONTENT_TYPES", "image/*, video/*")
+	t.Setenv("COMPRESS_BODYLESS_STATUSES", "204")
+	t.Setenv("COMPRESS_FLUSH_INTERVAL", "100ms")
+
+	opts, err := OptionsFromEnv("COMPRESS")
+	if assert.NoError(t, err) {
+		assert.Equal(t, gzip.BestCompression, opts.Level)
+		assert.Equal(t, 1024, opts.MinLength)
+		assert.Equal(t, ETagSuffix, opts.ETag)
+		assert.True(t, opts.SkipSetCookie)
+		assert.Equal(t, 0.25, opts.ShadowRate)
+		assert.Equal(t, []string{"image/*", "video/*"}, opts.ExcludedContentTypes)
+		assert.Equal(t, []int{http.StatusNoContent}, opts.BodylessStatuses)
+		assert.Equal(t, 100*time.Millisecond, opts.FlushInterval)
+		// Unset variables keep the defaults.
+		assert.Equal(t, 1<<20, opts.MaxBufferSize)
+		assert.False(t, opts.HTTP2Buffer)
+	}
+
+	t.Setenv("COMPRESS_LEVEL", "fast")
+	_, err = OptionsFromEnv("COMPRESS")
+	assert.EqualError(t, err, `compress: COMPRESS_LEVEL: strconv.Atoi: parsing "fast": invalid syntax`)
+}
+
+func TestGzipConfig(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.Expvar = expvarName(t)
+	config, err := NewConfig(opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mux := route.NewServeMux()
+	mux.Use(config.Middleware())
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, string(EncodingGzip), serve().Header().Get(route.HeaderContentEncoding))
+
+	opts.MinLength = 1024
+	if assert.NoError(t, config.Update(opts)) {
+		assert.Equal(t, 1024, config.Options().MinLength)
+		assert.Empty(t, serve().Header().Get(route.HeaderContentEncoding))
+	}
+
+	// Invalid options keep the current ones.
+	opts.Level = 42
+	assert.True(t, errors.Is(config.Update(opts), ErrInvalidLevel))
+	assert.Equal(t, -1, config.Options().Level)
+
+	// The published collector survives updates.
+	v := expvar.Get(opts.Expvar)
+	if assert.NotNil(t, v) {
+		var counters Counters
+		assert.NoError(t, json.Unmarshal([]byte(v.String()), &counters))
+		assert.Equal(t, int64(2), counters.Requests)
+	}
+}
+
+func TestGzipConfigHandler(t *testing.T) {
+	config, err := NewConfig(GetDefaultOptions())
+	if !assert.NoError(t, err) {
+		return
+	}
+	mux := route.NewServeMux()
+	h := ConfigHandler(config)
+
+	rec := httptest.NewRecorder()
+	c := mux.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	if assert.NoError(t, h(c)) {
+		var opts Options
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &opts))
+		assert.Equal(t, -1, opts.Level)
+		assert.Equal(t, "no-store", rec.Header().Get(headerCacheControl))
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(`{"level":9,"disabled":true}`))
+	c = mux.NewContext(req, rec)
+	if assert.NoError(t, h(c)) {
+		assert.Equal(t, gzip.BestCompression, config.Options().Level)
+		assert.True(t, config.Options().Disabled)
+		// Untouched fields keep their value.
+		assert.Equal(t, 1<<20, config.Options().MaxBufferSize)
+	}
+
+	// Disabled passes responses through.
+	mux.Use(config.Middleware())
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+	assert.Empty(t, rec.Header().Get(route.HeaderVary))
+
+	for _, body := range []string{`{"level":42}`, `{"level":`} {
+		req = httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+		err = h(mux.NewContext(req, httptest.NewRecorder()))
+		if he, ok := err.(*route.HTTPError); assert.True(t, ok) {
+			assert.Equal(t, http.StatusBadRequest, he.Code)
+		}
+	}
+	assert.Equal(t, gzip.BestCompression, config.Options().Level)
+
+	// A rejected patch leaves the options untouched, slices and maps
+	// included.
+	patch := func(body string) error {
+		req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body))
+		return h(mux.NewContext(req, httptest.NewRecorder()))
+	}
+	assert.NoError(t, patch(`{"excluded_content_types":["image/png","image/gif"],"aliases":{"gzip-custom":"gzip","x-old":"gzip"}}`))
+	before, _ := json.Marshal(config.Options())
+	assert.Error(t, patch(`{"excluded_content_types":["text/plain"],"aliases":{"x-new":"gzip"},"level":42}`))
+	after, _ := json.Marshal(config.Options())
+	assert.Equal(t, string(before), string(after))
+	assert.Equal(t, []string{"image/png", "image/gif"}, config.Options().ExcludedContentTypes)
+
+	// Maps are replaced, so that entries can be removed.
+	assert.NoError(t, patch(`{"aliases":{"x-new":"gzip"}}`))
+	assert.Equal(t, map[string]Encoding{"x-new": EncodingGzip}, config.Options().Aliases)
+
+	err = h(mux.NewContext(httptest.NewRequest(http.MethodPost, "/", nil), httptest.NewRecorder()))
+	assert.Equal(t, route.ErrMethodNotAllowed, err)
+}
+
+func TestGzipGroupOverride(t *testing.T) {
+	global, api := NewCollector(), NewCollector()
+	mux := route.NewServeMux()
+	mux.Use(New(DebugHeader(true), Collect(global)))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	g := mux.Group("/api")
+	g.Use(New(Level(gzip.BestSpeed), Collect(api)))
+	g.GET("/test", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	static := mux.Group("/static")
+	static.Use(New(Disabled(true)))
+	static.GET("/test", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("/")
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	assert.NotEmpty(t, rec.Header().Get(HeaderCompress))
+
+	rec = serve("/api/test")
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	assert.Empty(t, rec.Header().Get(HeaderCompress))
+	r, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "test", string(b))
+	}
+
+	rec = serve("/static/test")
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(t, "test", rec.Body.String())
+
+	assert.Equal(t, int64(1), global.Stats().Requests)
+	assert.Equal(t, int64(1), api.Stats().Requests)
+
+	// The group instance sees the request and response as they were before
+	// the global one ran.
+	mux = route.NewServeMux()
+	mux.Use(New(Edge(true), ETag(ETagSuffix)))
+	g = mux.Group("/api")
+	g.Use(New(Vary(VarySkip)))
+	g.GET("/test", func(c route.Context) error {
+		assert.Equal(t, string(EncodingGzip), c.Request().Header.Get(route.HeaderAcceptEncoding))
+		assert.Equal(t, `"v1-gzip"`, c.Request().Header.Get("If-None-Match"))
+		return c.String(http.StatusOK, "test")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/api/test", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	req.Header.Set("If-None-Match", `"v1-gzip"`)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	assert.Empty(t, rec.Header().Values(route.HeaderVary))
+}
+
+func TestGzipProvider(t *testing.T) {
+	fast := GetDefaultOptions()
+	fast.Level = gzip.BestSpeed
+	fast.DebugHeader = true
+	invalid := GetDefaultOptions()
+	invalid.Level = 42
+	tenants := map[string]*Options{"fast": &fast, "invalid": &invalid}
+
+	mux := route.NewServeMux()
+	mux.Use(New(Provider(func(c route.Context) *Options {
+		return tenants[c.Request().Header.Get("X-Tenant")]
+	})))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	serve := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		req.Header.Set("X-Tenant", tenant)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("fast")
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	assert.Contains(t, rec.Header().Get(HeaderCompress), "level=1")
+
+	rec = serve("other")
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	assert.Empty(t, rec.Header().Get(HeaderCompress))
+
+	rec = serve("invalid")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// A provider allocating options per request is stopped before it
+	// builds middleware without bound.
+	var err error
+	mw := New(Provider(func(c route.Context) *Options {
+		opts := GetDefaultOptions()
+		return &opts
+	}))
+	for i := 0; i <= maxProviderOptions && err == nil; i++ {
+		c := mux.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		err = mw(c, func(c route.Context) error {
+			return c.String(http.StatusOK, "test")
+		})
+	}
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestGzipSetOptions(t *testing.T) {
+	premium := GetDefaultOptions()
+	premium.Level = gzip.BestCompression
+	premium.DebugHeader = true
+	fallback := GetDefaultOptions()
+	fallback.Disabled = true
+
+	mux := route.NewServeMux()
+	mux.Use(func(c route.Context, next route.HandlerFunc) error {
+		if c.Request().Header.Get("X-Plan") == "premium" {
+			SetOptions(c, &premium)
+		}
+		return next(c)
+	})
+	mux.Use(New(Provider(func(c route.Context) *Options {
+		return &fallback
+	})))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	serve := func(plan string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		req.Header.Set("X-Plan", plan)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The context override takes precedence over the provider.
+	rec := serve("premium")
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	assert.Contains(t, rec.Header().Get(HeaderCompress), "level=9")
+
+	rec = serve("free")
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+
+	c := route.NewServeMux().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+	assert.Nil(t, OptionsFromContext(c))
+	SetOptions(c, &premium)
+	assert.Equal(t, &premium, OptionsFromContext(c))
+}
+
+func TestGzipRolloutPercent(t *testing.T) {
+	serve := func(mw route.MiddlewareFunc, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		c := route.NewServeMux().NewContext(req, rec)
+		err := mw(c, func(c route.Context) error {
+			return c.String(http.StatusOK, "test")
+		})
+		assert.NoError(t, err)
+		if rec.Header().Get(route.HeaderContentEncoding) == "" {
+			reason, _ := GetSkipReason(c)
+			assert.Equal(t, SkipNotSampled, reason)
+		}
+		return rec
+	}
+	byUser := RolloutKey(func(c route.Context) string {
+		return c.Request().Header.Get("X-User")
+	})
+	compressed := func(percent float64) map[string]bool {
+		mw := New(RolloutPercent(percent), byUser)
+		users := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			user := fmt.Sprintf("user-%d", i)
+			if serve(mw, user).Header().Get(route.HeaderContentEncoding) != "" {
+				users[user] = true
+			}
+		}
+		return users
+	}
+
+	assert.Len(t, compressed(0), 0)
+	assert.InDelta(t, 500, len(compressed(50)), 75)
+	assert.Len(t, compressed(100), 1000)
+	assert.Equal(t, 100.0, GetDefaultOptions().RolloutPercent)
+	// Clients out of the rollout are still counted, unlike with Disabled.
+	collector := NewCollector()
+	serve(New(RolloutPercent(0), Collect(collector)), "user-1")
+	assert.Equal(t, int64(1), collector.Stats().Skipped[SkipNotSampled])
+	five, twenty := compressed(5), compressed(20)
+	assert.InDelta(t, 50, len(five), 25)
+	assert.InDelta(t, 200, len(twenty), 50)
+	// Clients keep their treatment, and stay in as the rollout widens.
+	assert.Equal(t, five, compressed(5))
+	for user := range five {
+		assert.True(t, twenty[user], user)
+	}
+
+	// The default key is the remote host.
+	mw := New(RolloutPercent(50))
+	first := serve(mw, "").Header().Get(route.HeaderContentEncoding)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, first, serve(mw, "").Header().Get(route.HeaderContentEncoding))
+	}
+
+	for _, percent := range []float64{-1, 101} {
+		_, err := Builder().RolloutPercent(percent).Build()
+		assert.True(t, errors.Is(err, ErrInvalidOption), percent)
+	}
+}
+
+func TestGzipSelector(t *testing.T) {
+	type selection struct {
+		encoding string
+		level    int
+	}
+	flags := map[string]selection{
+		"fast":    {"gzip", gzip.BestSpeed},
+		"best":    {"", gzip.BestCompression},
+		"off":     {"IDENTITY", 0},
+		"brotli":  {"br", gzip.BestSpeed},
+		"invalid": {"gzip", 42},
+	}
+	mw := New(DebugHeader(true), Selector(func(c route.Context) (string, int, bool) {
+		s, ok := flags[c.Request().Header.Get("X-User")]
+		return s.encoding, s.level, ok
+	}))
+	serve := func(user, accept string) (*httptest.ResponseRecorder, route.Context, error) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, accept)
+		req.Header.Set("X-User", user)
+		rec := httptest.NewRecorder()
+		c := route.NewServeMux().NewContext(req, rec)
+		err := mw(c, func(c route.Context) error {
+			return c.String(http.StatusOK, "test")
+		})
+		return rec, c, err
+	}
+
+	for user, level := range map[string]string{"fast": "level=1", "best": "level=9", "brotli": "level=-1", "other": "level=-1"} {
+		rec, _, err := serve(user, string(EncodingGzip))
+		assert.NoError(t, err, user)
+		assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding), user)
+		assert.Contains(t, rec.Header().Get(HeaderCompress), level, user)
+	}
+
+	rec, c, err := serve("off", string(EncodingGzip))
+	assert.NoError(t, err)
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+	reason, _ := GetSkipReason(c)
+	assert.Equal(t, SkipSelected, reason)
+	assert.Equal(t, "selected", SkipSelected.String())
+
+	// The selection never overrides Accept-Encoding.
+	rec, _, err = serve("fast", string(EncodingIdentity))
+	assert.NoError(t, err)
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+
+	_, _, err = serve("invalid", string(EncodingGzip))
+	assert.True(t, errors.Is(err, ErrInvalidLevel))
+}
+
+func TestGzipPerHost(t *testing.T) {
+	fast := GetDefaultOptions()
+	fast.Level = gzip.BestSpeed
+	fast.DebugHeader = true
+	off := GetDefaultOptions()
+	off.Disabled = true
+
+	mux := route.NewServeMux()
+	mux.Use(New(PerHost(map[string]Options{
+		"Fast.example.com": fast,
+		"*.example.com":    off,
+	})))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	serve := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, host := range []string{"fast.example.com", "FAST.example.com:8443", "fast.example.com."} {
+		rec := serve(host)
+		assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding), host)
+		assert.Contains(t, rec.Header().Get(HeaderCompress), "level=1", host)
+	}
+	for _, host := range []string{"www.example.com", "a.b.example.com"} {
+		rec := serve(host)
+		assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding), host)
+	}
+	// Other hosts, and example.com itself, fall back to the options.
+	for _, host := range []string{"example.com", "example.org"} {
+		rec := serve(host)
+		assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding), host)
+		assert.Empty(t, rec.Header().Get(HeaderCompress), host)
+	}
+
+	// Entries loaded from JSON start from the default options.
+	opts := GetDefaultOptions()
+	err := json.Unmarshal([]byte(`{"per_host":{"a.com":{"level":5,"debug_header":true}}}`), &opts)
+	if assert.NoError(t, err) {
+		entry := opts.PerHost["a.com"]
+		assert.Equal(t, GetDefaultOptions().MaxBufferSize, entry.MaxBufferSize)
+		assert.Equal(t, GetDefaultOptions().SniffLength, entry.SniffLength)
+		assert.Equal(t, GetDefaultOptions().BodylessStatuses, entry.BodylessStatuses)
+		mw, err := NewWithOptions(opts)
+		if assert.NoError(t, err) {
+			mux := route.NewServeMux()
+			mux.Use(mw)
+			mux.GET("/", func(c route.Context) error {
+				return c.String(http.StatusOK, "test")
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "a.com"
+			req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+			assert.Contains(t, rec.Header().Get(HeaderCompress), "level=5")
+		}
+	}
+
+	// And so do entries loaded from YAML, leaving out the level too.
+	opts = GetDefaultOptions()
+	err = yaml.Unmarshal([]byte("per_host:\n  a.com:\n    debug_header: true\n"), &opts)
+	if assert.NoError(t, err) {
+		entry := opts.PerHost["a.com"]
+		assert.True(t, entry.DebugHeader)
+		assert.Equal(t, GetDefaultOptions().Level, entry.Level)
+		assert.Equal(t, GetDefaultOptions().MaxBufferSize, entry.MaxBufferSize)
+		assert.Equal(t, GetDefaultOptions().SniffLength, entry.SniffLength)
+		assert.Equal(t, GetDefaultOptions().BodylessStatuses, entry.BodylessStatuses)
+	}
+
+	invalid := GetDefaultOptions()
+	invalid.Level = 42
+	_, err = Builder().PerHost(map[string]Options{"example.com": invalid}).Build()
+	assert.True(t, errors.Is(err, ErrInvalidLevel))
+	assert.Contains(t, err.Error(), `"example.com"`)
+
+	// Hosts cannot publish their counters under the same name.
+	published := GetDefaultOptions()
+	published.Expvar = expvarName(t)
+	_, err = Builder().PerHost(map[string]Options{"a.com": published, "b.com": published}).Build()
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+	_, err = Builder().Expvar(published.Expvar).PerHost(map[string]Options{"a.com": published}).Build()
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestGzipGetWriter(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.Use(func(c route.Context, next route.HandlerFunc) error {
+		c.Response().Writer = &unwrapRecorder{c.Response().Writer}
+		return next(c)
+	})
+	mux.GET("/", func(c route.Context) error {
+		w, ok := GetWriter(c)
+		if !assert.True(t, ok) {
+			return nil
+		}
+		assert.False(t, w.Active())
+		assert.Empty(t, w.Encoding())
+		c.Response().Header().Set(route.HeaderContentType, route.MIMETextPlain)
+		_, err := c.Response().Write([]byte("test"))
+		assert.True(t, w.Active())
+		assert.Equal(t, EncodingGzip, w.Encoding())
+		_, ok = w.Unwrap().(*httptest.ResponseRecorder)
+		assert.True(t, ok)
+		return err
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	c := mux.NewContext(req, httptest.NewRecorder())
+	_, ok := GetWriter(c)
+	assert.False(t, ok)
+}
+
+func TestGzipSetDefaultOptions(t *testing.T) {
+	defer SetDefaultOptions(GetDefaultOptions())
+	opts := GetDefaultOptions()
+	opts.MinLength = 1024
+	opts.ExcludedContentTypes = []string{"image/*"}
+	opts.Skipper = nil
+	SetDefaultOptions(opts)
+
+	opts.ExcludedContentTypes[0] = "video/*"
+	defaults := GetDefaultOptions()
+	assert.Equal(t, 1024, defaults.MinLength)
+	assert.Equal(t, []string{"image/*"}, defaults.ExcludedContentTypes)
+	assert.NotNil(t, defaults.Skipper)
+
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+
+	opts.Level = 42
+	assert.Panics(t, func() {
+		SetDefaultOptions(opts)
+	})
+	assert.Equal(t, -1, GetDefaultOptions().Level)
+}
+
+func TestGzipBuilder(t *testing.T) {
+	b := Builder().Gzip(gzip.BestSpeed).MinLength(1024).ExcludedContentTypes("image/*").DebugHeader(true)
+	opts := b.Options()
+	assert.Equal(t, gzip.BestSpeed, opts.Level)
+	assert.Equal(t, 1024, opts.MinLength)
+	assert.Equal(t, []string{"image/*"}, opts.ExcludedContentTypes)
+	assert.True(t, opts.DebugHeader)
+	// Untouched options keep their default.
+	assert.Equal(t, 1<<20, opts.MaxBufferSize)
+
+	mw, err := b.Build()
+	if assert.NoError(t, err) {
+		mux := route.NewServeMux()
+		mux.Use(mw)
+		mux.GET("/", func(c route.Context) error {
+			return c.String(http.StatusOK, strings.Repeat("test", 1000))
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.True(t, strings.HasPrefix(rec.Header().Get(HeaderCompress), "gzip;level=1;"))
+	}
+
+	_, err = Builder().Gzip(42).Build()
+	assert.True(t, errors.Is(err, ErrInvalidLevel))
+}
+
+func TestGzipPresets(t *testing.T) {
+	dev := Development()
+	assert.Equal(t, gzip.BestSpeed, dev.Level)
+	assert.True(t, dev.DebugHeader)
+
+	prod := Production()
+	assert.Equal(t, 1024, prod.MinLength)
+	mw, err := NewWithOptions(prod)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mux := route.NewServeMux()
+	mux.Use(mw)
+	mux.GET("/:type", func(c route.Context) error {
+		body := strings.Repeat("test", 1000)
+		if c.Param("type") == "png" {
+			return c.Blob(http.StatusOK, "image/png", []byte(body))
+		}
+		return c.Blob(http.StatusOK, "image/svg+xml", []byte(body))
+	})
+	for path, encoding := range map[string]string{"/png": "", "/svg": string(EncodingGzip)} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, encoding, rec.Header().Get(route.HeaderContentEncoding), path)
+	}
+}
+
+func TestGzipVaryStrategy(t *testing.T) {
+	for strategy, want := range map[VaryStrategy][]string{
+		VaryMerge:   {"Origin", "Accept-Encoding"},
+		VaryReplace: {"Accept-Encoding"},
+		VarySkip:    {"Origin"},
+	} {
+		for _, conditional := range []bool{false, true} {
+			mux := route.NewServeMux()
+			mux.Use(func(c route.Context, next route.HandlerFunc) error {
+				c.Response().Header().Set(route.HeaderVary, "Origin")
+				return next(c)
+			})
+			mux.Use(New(Vary(strategy), ConditionalVary(conditional)))
+			mux.GET("/", func(c route.Context) error {
+				return c.String(http.StatusOK, "test")
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			assert.Equal(t, want, rec.Header()[route.HeaderVary], strategy.String())
+		}
+	}
+
+	var opts Options
+	assert.NoError(t, json.Unmarshal([]byte(`{"vary":"replace"}`), &opts))
+	assert.Equal(t, VaryReplace, opts.Vary)
+}
+
+func TestGzipNewGzip(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(NewGzip(Level(gzip.BestSpeed)))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, "br, gzip")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+}
+
+func TestGzipSniffer(t *testing.T) {
+	serve := func(mw route.MiddlewareFunc, path string) *httptest.ResponseRecorder {
+		mux := route.NewServeMux()
+		mux.Use(mw)
+		mux.GET("/*", func(c route.Context) error {
+			_, err := c.Response().Write([]byte(`{"test":true}`))
+			return err
+		})
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(New(), "/data.json")
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get(route.HeaderContentType))
+
+	rec = serve(New(Sniffer(SniffExtension), ExcludedContentTypes("application/json")), "/data.json")
+	assert.Equal(t, "application/json", rec.Header().Get(route.HeaderContentType))
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+
+	var sniffed []byte
+	rec = serve(New(Sniffer(func(c route.Context, data []byte) string {
+		sniffed = data
+		return ""
+	})), "/data")
+	assert.Equal(t, `{"test":true}`, string(sniffed))
+	assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get(route.HeaderContentType))
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+}
+
+func TestGzipSniffLength(t *testing.T) {
+	chunks := []string{"%PDF", "-1.7\n", strings.Repeat("x", 1000)}
+	for _, tt := range []struct {
+		length  int
+		sniffed int
+	}{
+		{0, 4},
+		{8, 8},
+		{512, 512},
+	} {
+		var sniffed []byte
+		mux := route.NewServeMux()
+		mux.Use(New(SniffLength(tt.length), ExcludedContentTypes("application/pdf"), Sniffer(func(c route.Context, data []byte) string {
+			sniffed = data
+			return ""
+		})))
+		mux.GET("/", func(c route.Context) error {
+			for _, chunk := range chunks {
+				if _, err := c.Response().Write([]byte(chunk)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Len(t, sniffed, tt.sniffed)
+		if tt.length == 0 {
+			// "%PDF" alone is not enough for http.DetectContentType.
+			assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+			continue
+		}
+		assert.Equal(t, "application/pdf", rec.Header().Get(route.HeaderContentType))
+		assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+		assert.Equal(t, strings.Join(chunks, ""), rec.Body.String())
+	}
+
+	// A body shorter than SniffLength is sniffed as a whole when it ends.
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/", func(c route.Context) error {
+		_, err := c.Response().Write([]byte("<html>"))
+		return err
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get(route.HeaderContentType))
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+}
+
+func TestGzipAliases(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New(Aliases(map[string]Encoding{"GZIP-Custom": EncodingGzip})))
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, "test")
+	})
+	for v, want := range map[string]string{
+		"gzip-custom":       string(EncodingGzip),
+		"gzip-custom;q=0":   "",
+		"x-gzip":            string(EncodingGzip),
+		"deflate-custom":    "",
+		"gzip-custom, gzip": string(EncodingGzip),
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, v)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Header().Get(route.HeaderContentEncoding), v)
+	}
+
+	t.Setenv("COMPRESS_ALIASES", "gzip-custom=gzip, legacy=gzip")
+	opts, err := OptionsFromEnv("COMPRESS")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]Encoding{"gzip-custom": EncodingGzip, "legacy": EncodingGzip}, opts.Aliases)
+	}
+
+	for encoding, valid := range map[Encoding]bool{EncodingBrotli: true, EncodingIdentity: true, "brr": false, "GZIP": false} {
+		_, err := Builder().Aliases(map[string]Encoding{"x-test": encoding}).Build()
+		assert.Equal(t, !valid, errors.Is(err, ErrInvalidOption), encoding)
+	}
+}
+
+func TestGzipWrap(t *testing.T) {
+	h := Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(route.HeaderContentType, route.MIMETextPlain)
+		io.WriteString(w, "test")
+		assert.NoError(t, http.NewResponseController(w).Flush())
+		io.WriteString(w, "test")
+	}), Level(gzip.BestSpeed))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(t, route.HeaderAcceptEncoding, rec.Header().Get(route.HeaderVary))
+	assert.True(t, rec.Flushed)
+	r, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "testtest", string(b))
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Empty(t, rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(t, "testtest", rec.Body.String())
+}
+
+func TestGzipTransport(t *testing.T) {
+	body := strings.Repeat("test", 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip, deflate", r.Header.Get(route.HeaderAcceptEncoding))
+		var buf bytes.Buffer
+		switch r.URL.Path {
+		case "/gzip":
+			Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, body)
+			})).ServeHTTP(w, r)
+			return
+		case "/zlib":
+			zw := zlib.NewWriter(&buf)
+			io.WriteString(zw, body)
+			zw.Close()
+		case "/deflate":
+			fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+			io.WriteString(fw, body)
+			fw.Close()
+		}
+		w.Header().Set(route.HeaderContentEncoding, string(EncodingDeflate))
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &Transport{}}
+
+	for _, path := range []string{"/gzip", "/zlib", "/deflate"} {
+		res, err := client.Get(srv.URL + path)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(b), path)
+		assert.True(t, res.Uncompressed)
+		assert.Empty(t, res.Header.Get(route.HeaderContentEncoding))
+		assert.Equal(t, int64(-1), res.ContentLength)
+	}
+
+	// A caller asking for an encoding itself gets the response as sent.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/zlib", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, "gzip, deflate")
+	res, err := client.Do(req)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.False(t, res.Uncompressed)
+		assert.Equal(t, string(EncodingDeflate), res.Header.Get(route.HeaderContentEncoding))
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestGzipTransportRequest(t *testing.T) {
+	body := strings.Repeat("test", 100)
+	var sent []*http.Request
+	transport := &Transport{
+		Base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent = append(sent, req)
+			b, err := ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			res := httptest.NewRecorder()
+			res.Write(b)
+			return res.Result(), nil
+		}),
+		CompressRequests: true,
+		RequestMinLength: 100,
+	}
+	decode := func(r io.Reader) string {
+		zr, err := gzip.NewReader(r)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		b, err := ioutil.ReadAll(zr)
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+	res, err := transport.RoundTrip(req)
+	if assert.NoError(t, err) && assert.Len(t, sent, 1) {
+		assert.Equal(t, string(EncodingGzip), sent[0].Header.Get(route.HeaderContentEncoding))
+		assert.Equal(t, int64(-1), sent[0].ContentLength)
+		assert.Equal(t, body, decode(res.Body))
+		// A replay is compressed as well.
+		if assert.NotNil(t, sent[0].GetBody) {
+			for i := 0; i < 2; i++ {
+				replay, err := sent[0].GetBody()
+				if assert.NoError(t, err) {
+					assert.Equal(t, body, decode(replay))
+				}
+			}
+		}
+	}
+	assert.Empty(t, req.Header.Get(route.HeaderContentEncoding))
+
+	sent = nil
+	req, _ = http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("short"))
+	res, err = transport.RoundTrip(req)
+	if assert.NoError(t, err) && assert.Len(t, sent, 1) {
+		assert.Empty(t, sent[0].Header.Get(route.HeaderContentEncoding))
+		b, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, "short", string(b))
+	}
+}
+
+func TestGzipEdge(t *testing.T) {
+	upstream := httptest.NewServer(Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("test", 100))
+	})))
+	defer upstream.Close()
+
+	for edge, want := range map[bool]SkipReason{false: SkipAlreadyEncoded, true: 0} {
+		var reason SkipReason
+		mux := route.NewServeMux()
+		mux.Use(New(Edge(edge), OnComplete(func(c route.Context, s Stats) {
+			reason, _ = GetSkipReason(c)
+		})))
+		mux.GET("/", func(c route.Context) error {
+			// A proxy passing the request headers on.
+			req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+			req.Header = c.Request().Header.Clone()
+			res, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			for k, v := range res.Header {
+				c.Response().Header()[k] = v
+			}
+			c.Response().WriteHeader(res.StatusCode)
+			_, err = io.Copy(c.Response(), res.Body)
+			return err
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+		assert.Equal(t, want, reason, "edge %v", edge)
+	}
+}
+
+func TestGzipTranscode(t *testing.T) {
+	body := strings.Repeat("test", 1000)
+	encode := func(coding Encoding) []byte {
+		var buf bytes.Buffer
+		var zw io.WriteCloser
+		if coding == EncodingDeflate {
+			zw, _ = zlib.NewWriterLevel(&buf, zlib.BestSpeed)
+		} else {
+			zw = gzip.NewWriter(&buf)
+		}
+		io.WriteString(zw, body)
+		zw.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		upstream Encoding
+		accept   string
+		want     Encoding
+		reason   SkipReason
+	}{
+		{EncodingGzip, "", "", SkipNotAccepted},
+		{EncodingDeflate, string(EncodingGzip), EncodingGzip, 0},
+		{EncodingGzip, string(EncodingGzip), EncodingGzip, SkipAlreadyEncoded},
+	}
+	for _, tt := range tests {
+		var reason SkipReason
+		mux := route.NewServeMux()
+		mux.Use(New(Transcode(true), OnComplete(func(c route.Context, s Stats) {
+			reason, _ = GetSkipReason(c)
+		})))
+		encoded := encode(tt.upstream)
+		mux.GET("/", func(c route.Context) error {
+			h := c.Response().Header()
+			h.Set(route.HeaderContentType, "text/plain")
+			h.Set(route.HeaderContentEncoding, string(tt.upstream))
+			h.Set(route.HeaderContentLength, strconv.Itoa(len(encoded)))
+			h.Set(headerETag, `"v1"`)
+			c.Response().WriteHeader(http.StatusOK)
+			// Written in small chunks, as a proxy streams it.
+			for b := encoded; len(b) > 0; {
+				n := 7
+				if n > len(b) {
+					n = len(b)
+				}
+				if _, err := c.Response().Write(b[:n]); err != nil {
+					return err
+				}
+				b = b[n:]
+			}
+			return nil
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.accept != "" {
+			req.Header.Set(route.HeaderAcceptEncoding, tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, string(tt.want), rec.Header().Get(route.HeaderContentEncoding), "upstream %s", tt.upstream)
+		assert.Equal(t, tt.reason, reason, "upstream %s", tt.upstream)
+		got := rec.Body.Bytes()
+		if tt.want != "" {
+			r, err := gzip.NewReader(rec.Body)
+			if assert.NoError(t, err) {
+				got, _ = io.ReadAll(r)
+			}
+		}
+		assert.Equal(t, body, string(got), "upstream %s", tt.upstream)
+		if tt.want != tt.upstream {
+			assert.Equal(t, `W/"v1"`, rec.Header().Get(headerETag)[:6])
+		}
+	}
+
+	// A corrupt body fails the request.
+	mux := route.NewServeMux()
+	var err error
+	mux.Use(func(c route.Context, next route.HandlerFunc) error {
+		err = next(c)
+		return err
+	})
+	mux.Use(New(Transcode(true)))
+	mux.GET("/", func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentEncoding, string(EncodingGzip))
+		_, err := c.Response().Write([]byte("not gzip"))
+		return err
+	})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Error(t, err)
+
+	// Hijacking stops the decoder midway, without leaking its goroutine.
+	goroutines := runtime.NumGoroutine()
+	encoded := encode(EncodingGzip)
+	c := route.NewServeMux().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), hijackRecorder{httptest.NewRecorder()})
+	err = New(Transcode(true))(c, func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentEncoding, string(EncodingGzip))
+		if _, err := c.Response().Write(encoded[:len(encoded)/2]); err != nil {
+			return err
+		}
+		conn, _, err := c.Response().Hijack()
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+	assert.NoError(t, err)
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= goroutines, "%d goroutines, %d before", runtime.NumGoroutine(), goroutines)
+}
+
+// hijackRecorder is a ResponseRecorder that can be hijacked, handing out one
+// end of a pipe.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+func TestGzipWebSocket(t *testing.T) {
+	_, err := NewWebSocketNegotiator(Level(42))
+	assert.True(t, errors.Is(err, ErrInvalidLevel))
+	n, err := NewWebSocketNegotiator()
+	if !assert.NoError(t, err) {
+		return
+	}
+	h := http.Header{}
+	h.Add(headerSecWebSocketExtensions, "permessage-deflate; server_max_window_bits=10, permessage-deflate; client_max_window_bits")
+	d, ok := n.Negotiate(h)
+	if assert.True(t, ok) {
+		assert.Equal(t, "permessage-deflate", d.Header())
+	}
+	h.Set(headerSecWebSocketExtensions, "x-webkit-deflate-frame, permessage-deflate; server_max_window_bits=10")
+	_, ok = n.Negotiate(h)
+	assert.False(t, ok)
+	h.Set(headerSecWebSocketExtensions, "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
+	disabled, err := NewWebSocketNegotiator(Disabled(true))
+	if assert.NoError(t, err) {
+		_, ok = disabled.Negotiate(h)
+		assert.False(t, ok)
+	}
+	n, err = NewWebSocketNegotiator(MinLength(10))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, takeover := range []bool{true, false} {
+		d, ok := n.Negotiate(h)
+		if !assert.True(t, ok) {
+			return
+		}
+		assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover", d.Header())
+		d.ServerNoContextTakeover = !takeover
+		d.ClientNoContextTakeover = !takeover
+		d.MaxMessageSize = 1000
+
+		// A client sharing its compression context across messages, or not.
+		var sent bytes.Buffer
+		cw, _ := flate.NewWriter(&sent, flate.DefaultCompression)
+		var received bytes.Buffer
+		for i := 0; i < 3; i++ {
+			msg := strings.Repeat("message ", 100)
+			sent.Reset()
+			cw.Write([]byte(msg))
+			cw.Flush()
+			if !takeover {
+				cw.Reset(&sent)
+			}
+			payload := bytes.TrimSuffix(sent.Bytes(), []byte(deflateTail))
+			if i > 0 && takeover {
+				assert.True(t, len(payload) < 16, "context takeover")
+			}
+			got, err := d.Decompress(payload)
+			assert.NoError(t, err)
+			assert.Equal(t, msg, string(got))
+
+			out, compressed, err := d.Compress([]byte(msg))
+			assert.NoError(t, err)
+			assert.True(t, compressed)
+			received.Write(out)
+			received.WriteString(deflateTail)
+		}
+		// The messages received read as one stream with context takeover.
+		if takeover {
+			r := flate.NewReader(io.MultiReader(&received, strings.NewReader("\x01\x00\x00\xff\xff")))
+			got, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, strings.Repeat("message ", 300), string(got))
+		}
+
+		out, compressed, err := d.Compress([]byte("short"))
+		assert.NoError(t, err)
+		assert.False(t, compressed)
+		assert.Equal(t, "short", string(out))
+
+		sent.Reset()
+		cw.Reset(&sent)
+		cw.Write(bytes.Repeat([]byte("x"), 2000))
+		cw.Flush()
+		_, err = d.Decompress(bytes.TrimSuffix(sent.Bytes(), []byte(deflateTail)))
+		assert.True(t, errors.Is(err, ErrMessageTooLarge))
+		d.Close()
+	}
+}
+
+func TestGzipCodec(t *testing.T) {
+	data := strings.Repeat("test", 100)
+	for _, encoding := range []string{"gzip", "X-Gzip", "deflate", "identity", ""} {
+		var buf bytes.Buffer
+		w, err := NewWriter(encoding, &buf, gzip.BestSpeed)
+		if !assert.NoError(t, err, encoding) {
+			continue
+		}
+		io.WriteString(w, data)
+		assert.NoError(t, w.Close())
+		if encoding != "identity" && encoding != "" {
+			assert.True(t, buf.Len() < len(data), encoding)
+		}
+		r, err := NewReader(encoding, &buf)
+		if !assert.NoError(t, err, encoding) {
+			continue
+		}
+		got, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		assert.Equal(t, data, string(got), encoding)
+	}
+
+	// Raw DEFLATE is read as deflate too.
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	io.WriteString(fw, data)
+	fw.Close()
+	r, err := NewReader("deflate", &buf)
+	if assert.NoError(t, err) {
+		got, _ := io.ReadAll(r)
+		assert.Equal(t, data, string(got))
+	}
+
+	_, err = NewWriter(string(EncodingBrotli), &buf, gzip.BestSpeed)
+	assert.True(t, errors.Is(err, ErrUnsupportedEncoding))
+	_, err = NewReader(string(EncodingZstd), &buf)
+	assert.True(t, errors.Is(err, ErrUnsupportedEncoding))
+	_, err = NewWriter("gzip", &buf, 10)
+	assert.True(t, errors.Is(err, ErrInvalidLevel))
+}
+
+func TestGzipZip(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.html":    {Data: []byte(strings.Repeat("<p>test</p>", 100))},
+		"site/css/style.css": {Data: []byte("body {}")},
+		"site/empty/.keep":   {Data: nil},
+		"other/ignored.txt":  {Data: []byte("ignored")},
+	}
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/site.zip", Zip(fsys, "site"))
+	mux.GET("/missing.zip", Zip(fsys, "missing"))
+
+	req := httptest.NewRequest(http.MethodGet, "/site.zip", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(t, "application/zip", rec.Header().Get(route.HeaderContentType))
+	assert.Equal(t, `attachment; filename=site.zip`, rec.Header().Get(route.HeaderContentDisposition))
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if assert.NoError(t, err) {
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		assert.Equal(t, []string{"css/", "css/style.css", "empty/", "empty/.keep", "index.html"}, names)
+		r, err := zr.Open("index.html")
+		if assert.NoError(t, err) {
+			data, _ := io.ReadAll(r)
+			assert.Equal(t, fsys["site/index.html"].Data, data)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/missing.zip", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Files from readers, in an archive whose name is not ASCII.
+	mux.GET("/files.zip", func(c route.Context) error {
+		return WriteZip(c, "résumé 1.zip", ZipFile{
+			Name: "hello.txt",
+			Open: func() (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader("hello")), nil
+			},
+		})
+	})
+	req = httptest.NewRequest(http.MethodGet, "/files.zip", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, `attachment; filename*=utf-8''r%C3%A9sum%C3%A9%201.zip`, rec.Header().Get(route.HeaderContentDisposition))
+	_, params, err := mime.ParseMediaType(rec.Header().Get(route.HeaderContentDisposition))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "résumé 1.zip", params["filename"])
+	}
+	zr, err = zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if assert.NoError(t, err) && assert.Len(t, zr.File, 1) {
+		r, _ := zr.File[0].Open()
+		data, _ := io.ReadAll(r)
+		assert.Equal(t, "hello", string(data))
+	}
+}
+
+func TestGzipTarGz(t *testing.T) {
+	fsys := fstest.MapFS{
+		"site/index.html":    {Data: []byte(strings.Repeat("<p>test</p>", 100))},
+		"site/css/style.css": {Data: []byte("body {}")},
+		"other/ignored.txt":  {Data: []byte("ignored")},
+	}
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/site.tar.gz", TarGz(fsys, "site"))
+	mux.GET("/missing.tar.gz", TarGz(fsys, "missing"))
+
+	req := httptest.NewRequest(http.MethodGet, "/site.tar.gz", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "", rec.Header().Get(route.HeaderContentEncoding))
+	assert.Equal(t, "application/gzip", rec.Header().Get(route.HeaderContentType))
+	assert.Equal(t, `attachment; filename=site.tar.gz`, rec.Header().Get(route.HeaderContentDisposition))
+	gr, err := gzip.NewReader(rec.Body)
+	if assert.NoError(t, err) {
+		tr := tar.NewReader(gr)
+		files := make(map[string]string)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				assert.Equal(t, io.EOF, err)
+				break
+			}
+			data, _ := io.ReadAll(tr)
+			files[hdr.Name] = string(data)
+		}
+		assert.Equal(t, map[string]string{
+			"css/":          "",
+			"css/style.css": "body {}",
+			"index.html":    string(fsys["site/index.html"].Data),
+		}, files)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/missing.tar.gz", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+type renderItem struct {
+	ID   int      `json:"id" xml:"id"`
+	Tags []string `json:"tags" xml:"tag"`
+}
+
+// customItem marshals itself through its pointer, which encoding/json uses
+// for slice elements but not for array elements passed by value.
+type customItem struct {
+	A int
+}
+
+func (*customItem) MarshalJSON() ([]byte, error) {
+	return []byte(`"custom"`), nil
+}
+
+type renderFunc func(w io.Writer, name string, data interface{}, c route.Context) error
+
+func (f renderFunc) Render(w io.Writer, name string, data interface{}, c route.Context) error {
+	return f(w, name, data, c)
+}
+
+func TestGzipRender(t *testing.T) {
+	items := make([]renderItem, 100)
+	for i := range items {
+		items[i] = renderItem{ID: i, Tags: []string{"a", "<b>"}}
+	}
+	values := []interface{}{items, []renderItem{}, []renderItem(nil), [2]int{1, 2}, map[string]int{"a": 1}, []byte("raw"),
+		[]customItem{{A: 1}, {A: 2}}, [2]customItem{{A: 1}, {A: 2}}}
+	for _, query := range []string{"", "?pretty"} {
+		for _, v := range values {
+			mux := route.NewServeMux()
+			mux.Use(New())
+			mux.GET("/", func(c route.Context) error {
+				return JSON(c, http.StatusCreated, v)
+			})
+			req := httptest.NewRequest(http.MethodGet, "/"+query, nil)
+			req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusCreated, rec.Code)
+			assert.Equal(t, route.MIMEApplicationJSONCharsetUTF8, rec.Header().Get(route.HeaderContentType))
+			// The same body as Context.JSON.
+			want := httptest.NewRecorder()
+			c := route.NewServeMux().NewContext(httptest.NewRequest(http.MethodGet, "/"+query, nil), want)
+			c.JSON(http.StatusCreated, v)
+			body := rec.Body.Bytes()
+			if rec.Header().Get(route.HeaderContentEncoding) == string(EncodingGzip) {
+				r, err := gzip.NewReader(rec.Body)
+				if !assert.NoError(t, err) {
+					continue
+				}
+				body, _ = io.ReadAll(r)
+			}
+			assert.Equal(t, want.Body.String(), string(body), "%T%s", v, query)
+		}
+	}
+
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/xml", func(c route.Context) error {
+		return XML(c, http.StatusOK, struct {
+			XMLName xml.Name     `xml:"items"`
+			Items   []renderItem `xml:"item"`
+		}{Items: items})
+	})
+	mux.GET("/html", func(c route.Context) error {
+		return Render(c, http.StatusOK, renderFunc(func(w io.Writer, name string, data interface{}, c route.Context) error {
+			_, err := io.WriteString(w, strings.Repeat(name, data.(int)))
+			return err
+		}), "<p>test</p>", 100)
+	})
+	for path, contentType := range map[string]string{"/xml": route.MIMEApplicationXMLCharsetUTF8, "/html": route.MIMETextHTMLCharsetUTF8} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, contentType, rec.Header().Get(route.HeaderContentType))
+		assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+		r, err := gzip.NewReader(rec.Body)
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(r)
+			if path == "/xml" {
+				assert.True(t, strings.HasPrefix(string(body), xml.Header+"<items><item><id>0</id><tag>a</tag><tag>&lt;b&gt;</tag></item>"))
+			} else {
+				assert.Equal(t, strings.Repeat("<p>test</p>", 100), string(body))
+			}
+		}
+	}
+}
+
+func TestGzipProxy(t *testing.T) {
+	var accept string
+	upstream := httptest.NewServer(Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get(route.HeaderAcceptEncoding)
+		w.Header().Set(route.HeaderContentType, route.MIMETextPlainCharsetUTF8)
+		io.WriteString(w, strings.Repeat("test", 100))
+	})))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/", Proxy(target, func(res *http.Response) error {
+		// A transformation reading the plaintext body.
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(bytes.ToUpper(b)))
+		return nil
+	}))
+	for _, acceptEncoding := range []string{"", string(EncodingGzip), string(EncodingBrotli)} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if acceptEncoding != "" {
+			req.Header.Set(route.HeaderAcceptEncoding, acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, transportEncodings, accept)
+		body := rec.Body.Bytes()
+		if acceptEncoding == string(EncodingGzip) {
+			assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+			r, err := gzip.NewReader(rec.Body)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			body, _ = io.ReadAll(r)
+		} else {
+			assert.Equal(t, "", rec.Header().Get(route.HeaderContentEncoding))
+		}
+		assert.Equal(t, strings.Repeat("TEST", 100), string(body), acceptEncoding)
+	}
+}
+
+func TestGzipFlushInterval(t *testing.T) {
+	read := make(chan struct{})
+	mux := route.NewServeMux()
+	mux.Use(New(FlushInterval(10 * time.Millisecond)))
+	mux.GET("/", func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentType, "text/event-stream")
+		for i := 0; i < 3; i++ {
+			// No Flush: the timer sends each event.
+			fmt.Fprintf(c.Response(), "data: %d\n\n", i)
+			select {
+			case <-read:
+			case <-time.After(5 * time.Second):
+				return errors.New("event not received")
+			}
+		}
+		return nil
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	res, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, string(EncodingGzip), res.Header.Get(route.HeaderContentEncoding))
+	r, err := gzip.NewReader(res.Body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	br := bufio.NewReader(r)
+	for i := 0; i < 3; i++ {
+		line, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("data: %d\n", i), line)
+		br.ReadString('\n')
+		select {
+		case read <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler gone")
+		}
+	}
+	rest, err := io.ReadAll(br)
+	assert.NoError(t, err)
+	assert.Empty(t, rest)
+
+	_, err = NewWithOptions(Options{FlushInterval: -time.Second})
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+
+	// The timer leaves the header map to the handler, which sets declared
+	// trailers after writing, buffered or not.
+	for _, buffer := range []bool{true, false} {
+		mux := route.NewServeMux()
+		mux.Use(New(FlushInterval(time.Millisecond), Buffer(buffer)))
+		mux.GET("/", func(c route.Context) error {
+			c.Response().Header().Set("Trailer", "X-Sum")
+			io.WriteString(c.Response(), strings.Repeat("test", 1000))
+			time.Sleep(5 * time.Millisecond)
+			c.Response().Header().Set("X-Sum", "5")
+			return nil
+		})
+		srv := httptest.NewServer(mux)
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		res, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if assert.NoError(t, err) {
+			assert.Equal(t, string(EncodingGzip), res.Header.Get(route.HeaderContentEncoding))
+			assert.Empty(t, res.Header.Get("X-Sum"))
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			assert.Equal(t, "5", res.Trailer.Get("X-Sum"))
+		}
+		srv.Close()
+	}
+}
+
+func TestGzipFlushEvents(t *testing.T) {
+	for b, want := range map[string]bool{
+		"data: 1\n\n":     true,
+		"data: 1\r\n\r\n": true,
+		"data: 1\r\n\n":   true,
+		"data: 1\r\r":     true,
+		"data: 1\r\n":     false,
+		"data: 1\n":       false,
+		"\n":              false,
+	} {
+		assert.Equal(t, want, eventBoundary(0, []byte(b)), "%q", b)
+	}
+	assert.True(t, eventBoundary('\n', []byte("\n")))
+	assert.True(t, eventBoundary('\n', []byte("\r\n")))
+	assert.False(t, eventBoundary('\r', []byte("\n")))
+
+	read := make(chan struct{})
+	mux := route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/", func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentType, "text/event-stream; charset=utf-8")
+		for i := 0; i < 3; i++ {
+			// The blank line ending the event comes in a write of its own.
+			fmt.Fprintf(c.Response(), "data: %d\r\n", i)
+			io.WriteString(c.Response(), "\r\n")
+			select {
+			case <-read:
+			case <-time.After(5 * time.Second):
+				return errors.New("event not received")
+			}
+		}
+		return nil
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	res, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, string(EncodingGzip), res.Header.Get(route.HeaderContentEncoding))
+	r, err := gzip.NewReader(res.Body)
+	if !assert.NoError(t, err) {
+		return
+	}
+	br := bufio.NewReader(r)
+	for i := 0; i < 3; i++ {
+		line, err := br.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("data: %d\r\n", i), line)
+		br.ReadString('\n')
+		select {
+		case read <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler gone")
+		}
+	}
+
+	// Other content types are left to the handler.
+	mux = route.NewServeMux()
+	mux.Use(New())
+	mux.GET("/", func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentType, route.MIMETextPlain)
+		io.WriteString(c.Response(), "data: 1\n\n")
+		return nil
+	})
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.False(t, rec.Flushed)
+}
+
+type flushCountRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (r *flushCountRecorder) Flush() {
+	r.flushes++
+	r.ResponseRecorder.Flush()
+}
+
+func TestGzipFlushRecords(t *testing.T) {
+	for _, tt := range []struct {
+		contentType string
+		flush       bool
+		want        int
+	}{
+		{"application/x-ndjson", true, 3},
+		{"application/jsonl; charset=utf-8", true, 3},
+		{"application/x-ndjson", false, 0},
+		{route.MIMEApplicationJSON, true, 0},
+	} {
+		mux := route.NewServeMux()
+		mux.Use(New(FlushRecords(tt.flush)))
+		mux.GET("/", func(c route.Context) error {
+			c.Response().Header().Set(route.HeaderContentType, tt.contentType)
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(c.Response(), `{"id":%d,`, i)
+				io.WriteString(c.Response(), `"ok":true}`+"\n")
+			}
+			return nil
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := &flushCountRecorder{ResponseRecorder: httptest.NewRecorder()}
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, tt.want, rec.flushes, "%s %v", tt.contentType, tt.flush)
+		r, err := gzip.NewReader(rec.Body)
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(r)
+			assert.Equal(t, `{"id":0,"ok":true}`+"\n"+`{"id":1,"ok":true}`+"\n"+`{"id":2,"ok":true}`+"\n", string(body))
+		}
+	}
+}
+
+func TestGzipFlushPolicies(t *testing.T) {
+	policies := map[string]FlushStrategy{
+		"text/html":         FlushNone,
+		"Text/Event-Stream": FlushPerWrite,
+		"application/*":     FlushBoundary,
+		"text/csv":          FlushTimed,
+	}
+	for _, tt := range []struct {
+		contentType string
+		want        int
+	}{
+		{"text/event-stream", 4},
+		{"application/x-ndjson", 2},
+		{"application/vnd.api+json", 2},
+		// The timer does not flush HTML, but does flush the rest.
+		{route.MIMETextHTMLCharsetUTF8, 0},
+		{"text/csv", -1},
+		{route.MIMETextPlain, -1},
+	} {
+		mux := route.NewServeMux()
+		mux.Use(New(FlushInterval(time.Millisecond), FlushPolicies(policies)))
+		mux.GET("/", func(c route.Context) error {
+			c.Response().Header().Set(route.HeaderContentType, tt.contentType)
+			for _, s := range []string{"a,", "b\n", "c,", "d\n"} {
+				io.WriteString(c.Response(), s)
+			}
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := &flushCountRecorder{ResponseRecorder: httptest.NewRecorder()}
+		mux.ServeHTTP(rec, req)
+		if tt.want < 0 {
+			// At least once, depending on the timing of the writes.
+			assert.True(t, rec.flushes > 0, tt.contentType)
+		} else {
+			assert.Equal(t, tt.want, rec.flushes, tt.contentType)
+		}
+		r, err := gzip.NewReader(rec.Body)
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(r)
+			assert.Equal(t, "a,b\nc,d\n", string(body))
+		}
+	}
+
+	// Policies are written by name.
+	b, err := json.Marshal(Options{FlushPolicies: map[string]FlushStrategy{"text/html": FlushNone}})
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(b), `"flush_policies":{"text/html":"none"}`)
+		var opts Options
+		assert.NoError(t, json.Unmarshal(b, &opts))
+		assert.Equal(t, FlushNone, opts.FlushPolicies["text/html"])
+	}
+	_, err = NewWithOptions(Options{FlushPolicies: map[string]FlushStrategy{"text/csv": FlushTimed}})
+	assert.True(t, errors.Is(err, ErrConflictingOptions))
+	_, err = NewWithOptions(Options{FlushPolicies: map[string]FlushStrategy{"text/csv": 42}})
+	assert.True(t, errors.Is(err, ErrInvalidOption))
+}
+
+func TestGzipWriteThrough(t *testing.T) {
+	mux := route.NewServeMux()
+	mux.Use(New(WriteThrough(func(c route.Context) bool {
+		return c.Request().URL.Query().Get("live") != ""
+	})))
+	handler := func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentType, route.MIMETextPlain)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(c.Response(), "message %d;", i)
+		}
+		return nil
+	}
+	mux.GET("/", handler)
+	// Opting in per route.
+	mux.GET("/marked", handler, func(c route.Context, next route.HandlerFunc) error {
+		MarkWriteThrough(c)
+		return next(c)
+	})
+	for target, want := range map[string]int{"/": 0, "/?live=1": 3, "/marked": 3} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		rec := &flushCountRecorder{ResponseRecorder: httptest.NewRecorder()}
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.flushes, target)
+		r, err := gzip.NewReader(rec.Body)
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(r)
+			assert.Equal(t, "message 0;message 1;message 2;", string(body))
+		}
+	}
+}
+
+func TestGzipCodecFlush(t *testing.T) {
+	for encoding, want := range map[string]SkipReason{
+		string(EncodingGzip):     SkipAlreadyEncoded,
+		string(EncodingDeflate):  SkipAlreadyEncoded,
+		string(EncodingIdentity): SkipNotAccepted,
+	} {
+		chunkBuf := make([]byte, 5)
+		mux := route.NewServeMux()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		// The middleware passes the encoded body through.
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip)+", "+encoding)
+		if encoding == string(EncodingIdentity) {
+			req.Header.Set(route.HeaderAcceptEncoding, encoding)
+		}
+		rec := httptest.NewRecorder()
+
+		c := mux.NewContext(req, rec)
+		err := New()(c, func(c route.Context) error {
+			c.Response().Header().Set(route.HeaderContentType, "text/event-stream")
+			c.Response().Header().Set(route.HeaderContentEncoding, encoding)
+			w, err := NewWriter(encoding, c.Response(), gzip.DefaultCompression)
+			if err != nil {
+				return err
+			}
+			flusher := w.(interface{ Flush() error })
+
+			// Write and flush the first part of the data
+			w.Write([]byte("test\n"))
+			assert.NoError(t, flusher.Flush())
+
+			// Read the first part of the data
+			assert.True(t, rec.Flushed, encoding)
+			r, err := NewReader(encoding, rec.Body)
+			if !assert.NoError(t, err, encoding) {
+				return nil
+			}
+			_, err = io.ReadFull(r, chunkBuf)
+			assert.NoError(t, err, encoding)
+			assert.Equal(t, "test\n", string(chunkBuf))
+
+			// Write and flush the second part of the data
+			w.Write([]byte("test\n"))
+			assert.NoError(t, flusher.Flush())
+
+			_, err = io.ReadFull(r, chunkBuf)
+			assert.NoError(t, err, encoding)
+			assert.Equal(t, "test\n", string(chunkBuf))
+
+			// Write the final part of the data and return
+			w.Write([]byte("test"))
+			if err := w.Close(); err != nil {
+				return err
+			}
+			rest, err := io.ReadAll(r)
+			assert.NoError(t, err, encoding)
+			assert.Equal(t, "test", string(rest))
+			return nil
+		})
+		assert.NoError(t, err)
+		reason, _ := GetSkipReason(c)
+		assert.Equal(t, want, reason, encoding)
+	}
+}
+
+type slowFlushRecorder struct {
+	*httptest.ResponseRecorder
+	delay   time.Duration
+	flushes atomic.Int32
+}
+
+func (r *slowFlushRecorder) Flush() {
+	r.flushes.Add(1)
+	time.Sleep(r.delay)
+	r.ResponseRecorder.Flush()
+}
+
+func TestGzipFlushBackpressure(t *testing.T) {
+	serve := func(interval, delay time.Duration, handler route.HandlerFunc) {
+		mux := route.NewServeMux()
+		mux.Use(New(FlushInterval(interval)))
+		mux.GET("/", handler)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+		mux.ServeHTTP(&slowFlushRecorder{ResponseRecorder: httptest.NewRecorder(), delay: delay}, req)
+	}
+
+	// A flush by the handler sends what the timer was due to.
+	serve(20*time.Millisecond, 0, func(c route.Context) error {
+		rec := c.Response().Writer.(*ResponseWriter).ResponseWriter.(*slowFlushRecorder)
+		io.WriteString(c.Response(), "test")
+		c.Response().Flush()
+		time.Sleep(60 * time.Millisecond)
+		assert.Equal(t, int32(1), rec.flushes.Load())
+		return nil
+	})
+
+	// After a flush that blocked on a slow client, the timer waits as long.
+	serve(time.Millisecond, 100*time.Millisecond, func(c route.Context) error {
+		rec := c.Response().Writer.(*ResponseWriter).ResponseWriter.(*slowFlushRecorder)
+		io.WriteString(c.Response(), "test")
+		time.Sleep(150 * time.Millisecond)
+		assert.Equal(t, int32(1), rec.flushes.Load())
+		// Waits for the flush, if still in progress.
+		io.WriteString(c.Response(), "test")
+		time.Sleep(30 * time.Millisecond)
+		assert.Equal(t, int32(1), rec.flushes.Load())
+		time.Sleep(150 * time.Millisecond)
+		assert.Equal(t, int32(2), rec.flushes.Load())
+		return nil
+	})
+}
+
+func TestGzipRegisterCodec(t *testing.T) {
+	// A coding that upper-cases on the way in and lower-cases on the way out.
+	const upper Encoding = "x-upper"
+	RegisterCodec(upper, Codec{
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			b, err := io.ReadAll(r)
+			return io.NopCloser(bytes.NewReader(bytes.ToLower(b))), err
+		},
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopEncoder{writerFunc(func(b []byte) (int, error) {
+				return w.Write(bytes.ToUpper(b))
+			})}, nil
+		},
+	})
+	defer UnregisterCodec(upper)
+
+	var buf bytes.Buffer
+	w, err := NewWriter("X-Upper", &buf, gzip.DefaultCompression)
+	if assert.NoError(t, err) {
+		io.WriteString(w, "test")
+		assert.NoError(t, w.(interface{ Flush() error }).Flush())
+		assert.NoError(t, w.Close())
+		assert.Equal(t, "TEST", buf.String())
+	}
+	r, err := NewReader(string(upper), &buf)
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(r)
+		assert.Equal(t, "test", string(b))
+	}
+	assert.True(t, decodable(string(upper)))
+	opts := GetDefaultOptions()
+	opts.Aliases = map[string]Encoding{"legacy-upper": upper}
+	assert.NoError(t, opts.Validate())
+
+	assert.Panics(t, func() {
+		RegisterCodec(EncodingGzip, Codec{})
+	})
+	UnregisterCodec(upper)
+	_, err = NewReader(string(upper), &buf)
+	assert.True(t, errors.Is(err, ErrUnsupportedEncoding))
+	assert.False(t, decodable(string(upper)))
+	assert.True(t, errors.Is(opts.Validate(), ErrInvalidOption))
+}
+
+func TestGzipDecodeBody(t *testing.T) {
+	encode := func(encoding string, b []byte) []byte {
+		var buf bytes.Buffer
+		w, err := NewWriter(encoding, &buf, gzip.DefaultCompression)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		w.Write(b)
+		w.Close()
+		return buf.Bytes()
+	}
+	response := func(body []byte, codings ...string) *http.Response {
+		res := &http.Response{Header: make(http.Header), Body: io.NopCloser(bytes.NewReader(body))}
+		for _, coding := range codings {
+			res.Header.Add(route.HeaderContentEncoding, coding)
+		}
+		return res
+	}
+
+	// A response of the middleware.
+	body := strings.Repeat("test", 1000)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, string(EncodingGzip))
+	rec := httptest.NewRecorder()
+	c := route.NewServeMux().NewContext(req, rec)
+	err := New()(c, func(c route.Context) error {
+		return c.String(http.StatusOK, body)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, string(EncodingGzip), rec.Header().Get(route.HeaderContentEncoding))
+	b, err := DecodeBody(rec.Result())
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(b))
+
+	// Chained codings, in one header or several.
+	chained := encode("gzip", encode("deflate", []byte("test")))
+	b, err = DecodeBody(response(chained, "deflate, gzip"))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(b))
+	b, err = DecodeBody(response(chained, "deflate", "gzip"))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(b))
+
+	// Bodies decoded already are left alone.
+	res := response([]byte("test"), "gzip")
+	res.Uncompressed = true
+	b, err = DecodeBody(res)
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(b))
+	b, err = DecodeBody(response([]byte("test")))
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(b))
+
+	_, err = DecodeBody(response([]byte("test"), "br"))
+	assert.True(t, errors.Is(err, ErrUnsupportedEncoding))
+	_, err = DecodeBody(response([]byte("test"), "gzip"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,71 @@
+// Package compresstest provides utilities for testing handlers served
+// through the compress middleware, so that application tests need not decode
+// response bodies themselves.
+package compresstest
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/goroute/compress"
+	"github.com/goroute/route"
+)
+
+// ResponseRecorder is an httptest.ResponseRecorder that decodes the body
+// according to the Content-Encoding of the response. Body holds the bytes
+// as sent; Result and Decoded return them decoded.
+type ResponseRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+// NewRecorder returns an initialized ResponseRecorder.
+func NewRecorder() *ResponseRecorder {
+	return &ResponseRecorder{ResponseRecorder: httptest.NewRecorder()}
+}
+
+// Decoded returns the body decoded, undoing the content codings of the
+// response in the reverse order of Content-Encoding. It returns an error
+// wrapping compress.ErrUnsupportedEncoding for a coding the compress
+// package cannot decode, or the error decoding the body.
+func (r *ResponseRecorder) Decoded() ([]byte, error) {
+	return decode(r.Header().Values(route.HeaderContentEncoding), r.Body.Bytes())
+}
+
+// DecodedString returns the body decoded like Decoded, or an empty string if
+// it cannot be decoded.
+func (r *ResponseRecorder) DecodedString() string {
+	b, _ := r.Decoded()
+	return string(b)
+}
+
+// Result returns the response like httptest.ResponseRecorder.Result, with
+// the body decoded the way http.Transport decodes gzip: Content-Encoding and
+// Content-Length are removed and Uncompressed is set. A body that cannot be
+// decoded is returned as is.
+func (r *ResponseRecorder) Result() *http.Response {
+	res := r.ResponseRecorder.Result()
+	codings := res.Header.Values(route.HeaderContentEncoding)
+	if len(codings) == 0 {
+		return res
+	}
+	body, err := decode(codings, r.Body.Bytes())
+	if err != nil {
+		return res
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.Header.Del(route.HeaderContentEncoding)
+	res.Header.Del(route.HeaderContentLength)
+	res.ContentLength = int64(len(body))
+	res.Uncompressed = true
+	return res
+}
+
+// decode undoes the content codings listed in values.
+func decode(values []string, body []byte) ([]byte, error) {
+	return compress.DecodeBody(&http.Response{
+		Header: http.Header{route.HeaderContentEncoding: values},
+		Body:   io.NopCloser(bytes.NewReader(body)),
+	})
+}
@@ -0,0 +1,114 @@
+package compresstest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goroute/compress"
+	"github.com/goroute/route"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	body := strings.Repeat("test", 100)
+	mux := route.NewServeMux()
+	mux.Use(compress.New())
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, body)
+	})
+	for _, accept := range []string{"gzip", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, accept)
+		rec := NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, accept, rec.Header().Get(route.HeaderContentEncoding))
+		assert.Equal(t, body, rec.DecodedString())
+		res := rec.Result()
+		b, _ := io.ReadAll(res.Body)
+		assert.Equal(t, body, string(b))
+		assert.Equal(t, "", res.Header.Get(route.HeaderContentEncoding))
+		assert.Equal(t, accept != "", res.Uncompressed)
+	}
+}
+
+func TestRecorderChained(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	io.WriteString(zw, "test")
+	zw.Close()
+	var chained bytes.Buffer
+	gw := gzip.NewWriter(&chained)
+	gw.Write(buf.Bytes())
+	gw.Close()
+
+	rec := NewRecorder()
+	rec.Header().Set(route.HeaderContentEncoding, "deflate, gzip")
+	rec.Write(chained.Bytes())
+	b, err := rec.Decoded()
+	assert.NoError(t, err)
+	assert.Equal(t, "test", string(b))
+
+	rec = NewRecorder()
+	rec.Header().Set(route.HeaderContentEncoding, "br")
+	rec.WriteString("test")
+	_, err = rec.Decoded()
+	assert.True(t, errors.Is(err, compress.ErrUnsupportedEncoding))
+	b, _ = io.ReadAll(rec.Result().Body)
+	assert.Equal(t, "test", string(b))
+}
+
+func TestEncoder(t *testing.T) {
+	enc := &Encoder{Name: "x-test"}
+	enc.Register()
+	defer enc.Unregister()
+
+	var buf bytes.Buffer
+	w, err := compress.NewWriter("x-test", &buf, gzip.DefaultCompression)
+	if assert.NoError(t, err) {
+		io.WriteString(w, "test")
+		assert.NoError(t, w.Close())
+		assert.Equal(t, BeginMarker+"test"+EndMarker, buf.String())
+	}
+
+	// The recorder decodes it, and Transcode decodes it for clients that
+	// do not accept it.
+	mux := route.NewServeMux()
+	mux.Use(compress.New(compress.Transcode(true)))
+	mux.GET("/", func(c route.Context) error {
+		c.Response().Header().Set(route.HeaderContentEncoding, "x-test")
+		c.Response().Header().Set(route.HeaderContentType, route.MIMETextPlain)
+		_, err := c.Response().Write(buf.Bytes())
+		return err
+	})
+	for accept, want := range map[string]string{"x-test": "x-test", "": ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(route.HeaderAcceptEncoding, accept)
+		rec := NewRecorder()
+		mux.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Header().Get(route.HeaderContentEncoding))
+		assert.Equal(t, "test", rec.DecodedString(), accept)
+	}
+
+	// Injected errors.
+	failure := errors.New("failure")
+	enc.WriteErr, enc.FlushErr, enc.CloseErr = failure, failure, failure
+	w, _ = compress.NewWriter("x-test", &buf, gzip.DefaultCompression)
+	_, err = io.WriteString(w, "test")
+	assert.Equal(t, failure, err)
+	assert.Equal(t, failure, w.(interface{ Flush() error }).Flush())
+	assert.Equal(t, failure, w.Close())
+	enc.ReadErr = failure
+	_, err = compress.NewReader("x-test", &buf)
+	assert.Equal(t, failure, err)
+
+	enc.ReadErr = nil
+	_, err = compress.NewReader("x-test", strings.NewReader("test"))
+	assert.Equal(t, ErrMalformed, err)
+}
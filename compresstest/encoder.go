@@ -0,0 +1,123 @@
+package compresstest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/goroute/compress"
+)
+
+// Markers framing the data encoded by Encoder.
+const (
+	BeginMarker = "<compresstest>"
+	EndMarker   = "</compresstest>"
+)
+
+// ErrMalformed is returned when decoding data that Encoder did not encode.
+var ErrMalformed = errors.New("compresstest: data not framed by the markers")
+
+// Encoder is a fake content coding for deterministic tests. It encodes data
+// by framing it between BeginMarker and EndMarker without compressing it,
+// so that tests can see that it was applied and still read the body, and it
+// fails on demand. Register it under a coding of its own to use it through
+// compress.NewReader and compress.NewWriter, such as in Transcode or
+// Transport:
+//
+//	enc := &compresstest.Encoder{Name: "x-test"}
+//	enc.Register()
+//	defer enc.Unregister()
+type Encoder struct {
+	// Name is the content coding.
+	Name compress.Encoding
+
+	// WriteErr, FlushErr and CloseErr are returned by the Write, Flush and
+	// Close methods of the writers, and ReadErr by the readers, if not nil.
+	WriteErr error
+	FlushErr error
+	CloseErr error
+	ReadErr  error
+}
+
+// Codec returns the codec of e.
+func (e *Encoder) Codec() compress.Codec {
+	return compress.Codec{
+		NewReader: e.NewReader,
+		NewWriter: e.NewWriter,
+	}
+}
+
+// Register registers the codec of e for its Name with compress.RegisterCodec.
+func (e *Encoder) Register() {
+	compress.RegisterCodec(e.Name, e.Codec())
+}
+
+// Unregister removes the codec registered for the Name of e.
+func (e *Encoder) Unregister() {
+	compress.UnregisterCodec(e.Name)
+}
+
+// NewWriter returns a writer framing what is written to it to w. The level
+// is ignored.
+func (e *Encoder) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return &encoderWriter{e: e, w: w}, nil
+}
+
+// NewReader returns a reader of the data framed in r. It reads r whole.
+func (e *Encoder) NewReader(r io.Reader) (io.ReadCloser, error) {
+	if e.ReadErr != nil {
+		return nil, e.ReadErr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(BeginMarker)) || !bytes.HasSuffix(b[len(BeginMarker):], []byte(EndMarker)) {
+		return nil, ErrMalformed
+	}
+	return io.NopCloser(bytes.NewReader(b[len(BeginMarker) : len(b)-len(EndMarker)])), nil
+}
+
+type encoderWriter struct {
+	e       *Encoder
+	w       io.Writer
+	started bool
+}
+
+// start writes BeginMarker before the first data.
+func (ew *encoderWriter) start() error {
+	if ew.started {
+		return nil
+	}
+	ew.started = true
+	_, err := io.WriteString(ew.w, BeginMarker)
+	return err
+}
+
+func (ew *encoderWriter) Write(b []byte) (int, error) {
+	if ew.e.WriteErr != nil {
+		return 0, ew.e.WriteErr
+	}
+	if err := ew.start(); err != nil {
+		return 0, err
+	}
+	return ew.w.Write(b)
+}
+
+func (ew *encoderWriter) Flush() error {
+	if ew.e.FlushErr != nil {
+		return ew.e.FlushErr
+	}
+	return ew.start()
+}
+
+func (ew *encoderWriter) Close() error {
+	if ew.e.CloseErr != nil {
+		return ew.e.CloseErr
+	}
+	if err := ew.start(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(ew.w, EndMarker)
+	return err
+}
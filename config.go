@@ -0,0 +1,131 @@
+package compress
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/goroute/route"
+)
+
+// Config holds options that can be replaced while the server is running,
+// for example to change the level or MinLength from an admin endpoint
+// without restarting. Requests in flight finish with the options they
+// started with.
+type Config struct {
+	mu    sync.Mutex // serializes Update
+	state atomic.Pointer[configState]
+}
+
+type configState struct {
+	opts Options
+	mw   route.MiddlewareFunc
+}
+
+// NewConfig returns a Config holding opts. It returns the error of
+// Options.Validate if the options are invalid.
+func NewConfig(opts Options) (*Config, error) {
+	c := new(Config)
+	if err := c.Update(opts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Options returns the current options.
+func (c *Config) Options() Options {
+	return c.state.Load().opts
+}
+
+// Update validates opts and swaps them in for the requests that start from
+// now on. On error the current options are kept. Keeping the Expvar name of
+// the current options keeps publishing the same Collector, as expvar names
+// cannot be published twice; the state of AnomalyFactor detection starts
+// over.
+func (c *Config) Update(opts Options) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.update(opts)
+}
+
+// patch decodes the JSON object patch onto a copy of the current options
+// and updates c with the result. The copy shares no slices or maps with the
+// options in use, which a rejected patch must leave alone, and the maps
+// present in patch are replaced rather than merged into.
+func (c *Config) patch(patch []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	opts := c.Options().clone()
+	v := reflect.ValueOf(&opts).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if _, ok := fields[name]; ok && v.Field(i).Kind() == reflect.Map {
+			v.Field(i).SetZero()
+		}
+	}
+	if err := json.Unmarshal(patch, &opts); err != nil {
+		return err
+	}
+	return c.update(opts)
+}
+
+func (c *Config) update(opts Options) error {
+	build := opts
+	if prev := c.state.Load(); prev != nil && opts.Expvar != "" && opts.Expvar == prev.opts.Expvar {
+		if opts.Collector == nil {
+			opts.Collector = prev.opts.Collector
+		}
+		build.Collector, build.Expvar = opts.Collector, ""
+	}
+	if err := build.Validate(); err != nil {
+		return err
+	}
+	if build.Expvar != "" && build.Collector == nil {
+		opts.Collector = NewCollector()
+		build.Collector = opts.Collector
+	}
+	c.state.Store(&configState{opts: opts, mw: newMiddleware(build)})
+	return nil
+}
+
+// Middleware returns Gzip middleware that uses the current options of c.
+func (c *Config) Middleware() route.MiddlewareFunc {
+	return func(ctx route.Context, next route.HandlerFunc) error {
+		return c.state.Load().mw(ctx, next)
+	}
+}
+
+// ConfigHandler returns a handler for tuning config at runtime. GET and HEAD
+// reply with the current options as JSON. PATCH decodes a JSON object onto
+// the current options, so that only the fields present change, for example
+// {"level": 9} or {"disabled": true}; maps such as aliases are replaced
+// whole. It replies with the updated options, or 400 Bad Request if they are
+// invalid, in which case the current options are kept. The handler performs
+// no authentication: mount it behind the caller's own auth middleware.
+func ConfigHandler(config *Config) route.HandlerFunc {
+	return func(c route.Context) error {
+		c.Response().Header().Set(headerCacheControl, "no-store")
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPatch:
+			var patch json.RawMessage
+			if err := json.NewDecoder(c.Request().Body).Decode(&patch); err != nil {
+				return route.NewHTTPError(http.StatusBadRequest, err.Error()).SetInternal(err)
+			}
+			if err := config.patch(patch); err != nil {
+				return route.NewHTTPError(http.StatusBadRequest, err.Error()).SetInternal(err)
+			}
+		default:
+			c.Response().Header().Set(route.HeaderAllow, "GET, HEAD, PATCH")
+			return route.ErrMethodNotAllowed
+		}
+		return c.JSON(http.StatusOK, config.Options())
+	}
+}
@@ -0,0 +1,117 @@
+package compress
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OptionsFromEnv returns the default options overridden by environment
+// variables named after the yaml tags of the Options fields, upper-cased and
+// joined to prefix with an underscore: with prefix "COMPRESS", Level is read
+// from COMPRESS_LEVEL and MinLength from COMPRESS_MIN_LENGTH. Lists are
+// comma-separated, maps are lists of key=value pairs, and durations use the
+// syntax of time.ParseDuration, such as "100ms". Unset variables keep the
+// default. It returns an error if a variable cannot be parsed; pass the
+// result to NewWithOptions to validate it.
+func OptionsFromEnv(prefix string) (Options, error) {
+	opts := GetDefaultOptions()
+	v := reflect.ValueOf(&opts).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("yaml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := strings.ToUpper(tag)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), value); err != nil {
+			return opts, fmt.Errorf("compress: %s: %w", name, err)
+		}
+	}
+	return opts, nil
+}
+
+// setField parses value into the field f.
+func setField(f reflect.Value, value string) error {
+	if u, ok := f.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	if f.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(n))
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(x)
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Map:
+		m := reflect.MakeMap(f.Type())
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("%q is not a key=value pair", item)
+			}
+			key, elem := reflect.New(f.Type().Key()).Elem(), reflect.New(f.Type().Elem()).Elem()
+			if err := setField(key, strings.TrimSpace(k)); err != nil {
+				return err
+			}
+			if err := setField(elem, strings.TrimSpace(v)); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, elem)
+		}
+		f.Set(m)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		s := reflect.MakeSlice(f.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setField(s.Index(i), item); err != nil {
+				return err
+			}
+		}
+		f.Set(s)
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
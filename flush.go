@@ -0,0 +1,175 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/goroute/route"
+)
+
+// WriteThroughKey is the context key that makes the middleware flush the
+// response after every write when set to true, as MarkWriteThrough does.
+const WriteThroughKey = "compress.write_through"
+
+// MarkWriteThrough makes the middleware flush the compressed response of c
+// after every write, like the WriteThrough option. It must be called before
+// the first byte of the body is written.
+func MarkWriteThrough(c route.Context) {
+	c.Set(WriteThroughKey, true)
+}
+
+// FlushStrategy defines when the middleware flushes a compressed response
+// on its own, on top of the flushes of the handler.
+type FlushStrategy int
+
+const (
+	// FlushDefault applies the FlushInterval, FlushEvents and FlushRecords
+	// options.
+	FlushDefault FlushStrategy = iota
+	// FlushNone leaves flushing to the handler, for responses best
+	// compressed whole, such as HTML pages.
+	FlushNone
+	// FlushPerWrite flushes after every write of the handler.
+	FlushPerWrite
+	// FlushTimed flushes within FlushInterval of a write, which must be
+	// set.
+	FlushTimed
+	// FlushBoundary flushes at the end of each event of a
+	// text/event-stream, and after each line of other content types.
+	FlushBoundary
+)
+
+var flushStrategyNames = map[FlushStrategy]string{
+	FlushDefault:  "default",
+	FlushNone:     "none",
+	FlushPerWrite: "write",
+	FlushTimed:    "interval",
+	FlushBoundary: "boundary",
+}
+
+// String returns the name of the strategy.
+func (s FlushStrategy) String() string {
+	if name, ok := flushStrategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("FlushStrategy(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the strategy is
+// written by name in configuration files.
+func (s FlushStrategy) MarshalText() ([]byte, error) {
+	if _, ok := flushStrategyNames[s]; !ok {
+		return nil, fmt.Errorf("compress: unknown flush strategy %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *FlushStrategy) UnmarshalText(text []byte) error {
+	for strategy, name := range flushStrategyNames {
+		if name == string(text) {
+			*s = strategy
+			return nil
+		}
+	}
+	return fmt.Errorf("compress: unknown flush strategy %q", text)
+}
+
+// flushStrategy returns the strategy policies map the media type mt to: the
+// strategy of mt itself, else of its "type/*" wildcard, else FlushDefault.
+func flushStrategy(policies map[string]FlushStrategy, mt string) FlushStrategy {
+	if len(policies) == 0 {
+		return FlushDefault
+	}
+	if s, ok := policies[mt]; ok {
+		return s
+	}
+	if i := strings.IndexByte(mt, '/'); i >= 0 {
+		if s, ok := policies[mt[:i+1]+"*"]; ok {
+			return s
+		}
+	}
+	return FlushDefault
+}
+
+// checkFlush decides, on the first write, how the middleware flushes the
+// response, from its Content-Type.
+func (w *ResponseWriter) checkFlush() {
+	if w.flushChecked {
+		return
+	}
+	w.flushChecked = true
+	mt, _, _ := mime.ParseMediaType(w.Header().Get(route.HeaderContentType))
+	events := mt == "text/event-stream"
+	strategy := flushStrategy(w.flushPolicies, mt)
+	if w.writeThrough != nil && w.writeThrough() {
+		strategy = FlushPerWrite
+	}
+	switch strategy {
+	case FlushDefault:
+		w.timed = w.flushInterval > 0
+		switch {
+		case w.flushEvents && events:
+			w.boundary = eventBoundary
+		case w.flushRecords && (mt == "application/x-ndjson" || mt == "application/jsonl"):
+			w.boundary = recordBoundary
+		}
+	case FlushPerWrite:
+		w.boundary = writeBoundary
+	case FlushTimed:
+		w.timed = true
+	case FlushBoundary:
+		if events {
+			w.boundary = eventBoundary
+		} else {
+			w.boundary = recordBoundary
+		}
+	}
+}
+
+// flushBoundary flushes a compressed response when b ends a unit of the
+// stream, such as an event of a text/event-stream, so that it reaches the
+// client without waiting for the compressor to fill up.
+func (w *ResponseWriter) flushBoundary(b []byte) {
+	if w.checkFlush(); w.boundary == nil {
+		return
+	}
+	last := w.last
+	w.last = b[len(b)-1]
+	if w.gw != nil && w.boundary(last, b) {
+		w.flush()
+	}
+}
+
+// writeBoundary treats every write as a unit of the stream.
+func writeBoundary(byte, []byte) bool {
+	return true
+}
+
+// recordBoundary reports whether b ends a line, such as a record of
+// newline-delimited JSON.
+func recordBoundary(_ byte, b []byte) bool {
+	return bytes.IndexByte(b, '\n') >= 0
+}
+
+// eventBoundary reports whether b, written after the byte last, holds the
+// blank line that ends a server-sent event: two line endings in a row, each
+// CRLF, LF or CR.
+func eventBoundary(last byte, b []byte) bool {
+	prev := last
+	for _, c := range b {
+		if c == '\n' || c == '\r' {
+			if (prev == '\n' || prev == '\r') && !(prev == '\r' && c == '\n') {
+				return true
+			}
+			if prev == '\r' && c == '\n' {
+				// The LF of a CRLF, which a further CR must not pair with.
+				c = '\n'
+			}
+		}
+		prev = c
+	}
+	return false
+}
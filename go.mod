@@ -1,8 +1,14 @@
 module github.com/goroute/compress
 
-go 1.12
+go 1.21
 
 require (
 	github.com/goroute/route v0.0.0-20190718071306-63785885e8a5
 	github.com/stretchr/testify v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 )
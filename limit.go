@@ -0,0 +1,91 @@
+package compress
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limiter limits the number of bytes compressed per client with a token
+// bucket per key. Once a client has used up its budget its responses are
+// sent uncompressed until the bucket refills. It is safe for concurrent use.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter allowing each client to have rate
+// uncompressed bytes per second compressed, with bursts of up to burst bytes.
+func NewLimiter(rate, burst int64) *Limiter {
+	return &Limiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow reports whether the client key has budget left.
+func (l *Limiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.refill(key, time.Now()).tokens > 0
+}
+
+// use takes n bytes from the budget of the client key.
+func (l *Limiter) use(key string, n int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.refill(key, now).tokens -= float64(n)
+	l.prune(now)
+}
+
+// refill returns the bucket of key, topped up for the time elapsed since it
+// was last used.
+func (l *Limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	return b
+}
+
+// prune drops, at most once a minute, the buckets that have refilled
+// completely and so carry no state.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// remoteHost returns the host part of the remote address of r.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
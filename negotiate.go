@@ -0,0 +1,63 @@
+package compress
+
+import (
+	"strconv"
+	"strings"
+)
+
+// acceptedCoding is a content coding listed in Accept-Encoding with its
+// quality value.
+type acceptedCoding struct {
+	coding string
+	q      float64
+}
+
+func (a acceptedCoding) String() string {
+	return a.coding + ";q=" + strconv.FormatFloat(a.q, 'f', -1, 64)
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header value. Codings are
+// lower-cased and those listed in aliases replaced; a missing or malformed
+// quality value counts as 1.
+func parseAcceptEncoding(v string, aliases map[string]Encoding) []acceptedCoding {
+	var codings []acceptedCoding
+	for _, part := range strings.Split(v, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			// RFC 9110 asks to treat x-gzip as gzip.
+			coding = string(EncodingGzip)
+		} else if encoding, ok := aliases[coding]; ok {
+			coding = string(encoding)
+		}
+		a := acceptedCoding{coding: coding, q: 1}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if len(p) > 2 && (p[0] == 'q' || p[0] == 'Q') && p[1] == '=' {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q >= 0 && q <= 1 {
+					a.q = q
+				}
+			}
+		}
+		codings = append(codings, a)
+	}
+	return codings
+}
+
+// accepts reports whether codings allow coding: it is listed with a non-zero
+// quality value, or not listed and "*" is.
+func accepts(codings []acceptedCoding, coding Encoding) bool {
+	wildcard := false
+	for _, a := range codings {
+		switch a.coding {
+		case string(coding):
+			return a.q > 0
+		case "*":
+			wildcard = a.q > 0
+		}
+	}
+	return wildcard
+}
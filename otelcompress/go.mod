@@ -0,0 +1,28 @@
+module github.com/goroute/compress/otelcompress
+
+go 1.21
+
+// The replace directive builds against the enclosing checkout during
+// development. Go ignores it in dependencies: downstream modules get the
+// version required below, the release of compress to tag before this module.
+replace github.com/goroute/compress => ../
+
+require (
+	github.com/goroute/compress v0.1.0
+	github.com/goroute/route v0.0.0-20190718071306-63785885e8a5
+	github.com/stretchr/testify v1.8.4
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/metric v1.24.0
+	go.opentelemetry.io/otel/sdk v1.24.0
+	go.opentelemetry.io/otel/sdk/metric v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
@@ -0,0 +1,191 @@
+// Package otelcompress records OpenTelemetry metrics for the compress
+// middleware and annotates the active trace span with them. It lives in its
+// own module so that the middleware itself does not depend on OpenTelemetry.
+package otelcompress
+
+import (
+	"mime"
+
+	"github.com/goroute/compress"
+	"github.com/goroute/route"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/goroute/compress/otelcompress"
+
+// Attribute keys
+const (
+	// EncodingKey is the content coding of the response, "identity" when it
+	// was not compressed.
+	EncodingKey = attribute.Key("compress.encoding")
+	// ContentTypeKey is the media type of the response, without parameters.
+	ContentTypeKey = attribute.Key("compress.content_type")
+	// LevelKey is the compression level.
+	LevelKey = attribute.Key("compress.level")
+	// UncompressedSizeKey is the number of body bytes written by the handler.
+	UncompressedSizeKey = attribute.Key("compress.uncompressed_size")
+	// CompressedSizeKey is the number of body bytes sent to the client.
+	CompressedSizeKey = attribute.Key("compress.compressed_size")
+	// DurationKey is the time spent compressing the body, in seconds.
+	DurationKey = attribute.Key("compress.duration")
+)
+
+// Options defines the config for the instrumented middleware.
+type Options struct {
+	// MeterProvider provides the meter the instruments are created with.
+	// Optional. Default value otel.GetMeterProvider().
+	MeterProvider metric.MeterProvider
+
+	// Compress holds the options of the compress middleware.
+	// Optional. Default value nil.
+	Compress []compress.Option
+
+	// Spans adds the compression statistics of a response as attributes
+	// to the span active in the request context, if it is recording.
+	// Optional. Default value true.
+	Spans bool
+}
+
+// Option defines option func.
+type Option func(*Options)
+
+// GetDefaultOptions returns default options.
+func GetDefaultOptions() Options {
+	return Options{
+		MeterProvider: otel.GetMeterProvider(),
+		Spans:         true,
+	}
+}
+
+// MeterProvider sets meter provider option.
+func MeterProvider(provider metric.MeterProvider) Option {
+	return func(o *Options) {
+		o.MeterProvider = provider
+	}
+}
+
+// Compress sets compress option.
+func Compress(options ...compress.Option) Option {
+	return func(o *Options) {
+		o.Compress = options
+	}
+}
+
+// Spans sets spans option.
+func Spans(annotate bool) Option {
+	return func(o *Options) {
+		o.Spans = annotate
+	}
+}
+
+type instruments struct {
+	responses    metric.Int64Counter
+	uncompressed metric.Int64Counter
+	compressed   metric.Int64Counter
+	duration     metric.Float64Histogram
+	ratio        metric.Float64Histogram
+}
+
+// New returns the compress middleware configured with the Compress option,
+// recording metrics for every response it handles. It returns an error if
+// the options of compress are invalid, see compress.Options.Validate, or if
+// the instruments cannot be created.
+func New(options ...Option) (route.MiddlewareFunc, error) {
+	// Apply options.
+	opts := GetDefaultOptions()
+	for _, opt := range options {
+		opt(&opts)
+	}
+	meter := opts.MeterProvider.Meter(instrumentationName)
+	var (
+		inst instruments
+		err  error
+	)
+	if inst.responses, err = meter.Int64Counter("compress.responses",
+		metric.WithDescription("Number of responses handled by the compress middleware."),
+		metric.WithUnit("{response}")); err != nil {
+		return nil, err
+	}
+	if inst.uncompressed, err = meter.Int64Counter("compress.uncompressed_size",
+		metric.WithDescription("Body bytes written by handlers."),
+		metric.WithUnit("By")); err != nil {
+		return nil, err
+	}
+	if inst.compressed, err = meter.Int64Counter("compress.compressed_size",
+		metric.WithDescription("Body bytes sent to clients."),
+		metric.WithUnit("By")); err != nil {
+		return nil, err
+	}
+	if inst.duration, err = meter.Float64Histogram("compress.duration",
+		metric.WithDescription("Time spent compressing response bodies."),
+		metric.WithUnit("s")); err != nil {
+		return nil, err
+	}
+	if inst.ratio, err = meter.Float64Histogram("compress.ratio",
+		metric.WithDescription("Compressed to uncompressed size ratio of response bodies."),
+		metric.WithUnit("1")); err != nil {
+		return nil, err
+	}
+
+	compressOpts := compress.GetDefaultOptions()
+	for _, opt := range opts.Compress {
+		opt(&compressOpts)
+	}
+	mw, err := compress.NewWithOptions(compressOpts)
+	if err != nil {
+		return nil, err
+	}
+	return func(c route.Context, next route.HandlerFunc) error {
+		err := mw(c, next)
+		if s, ok := compress.GetStats(c); ok {
+			inst.record(c, s)
+			if opts.Spans {
+				annotate(trace.SpanFromContext(c.Request().Context()), s)
+			}
+		}
+		return err
+	}, nil
+}
+
+// record adds the statistics of a response to the instruments.
+func (inst *instruments) record(c route.Context, s compress.Stats) {
+	encoding := s.Encoding
+	if encoding == "" {
+		encoding = compress.EncodingIdentity
+	}
+	attrs := []attribute.KeyValue{EncodingKey.String(string(encoding))}
+	if ct := c.Response().Header().Get(route.HeaderContentType); ct != "" {
+		if mt, _, err := mime.ParseMediaType(ct); err == nil {
+			attrs = append(attrs, ContentTypeKey.String(mt))
+		}
+	}
+	set := metric.WithAttributes(attrs...)
+	ctx := c.Request().Context()
+	inst.responses.Add(ctx, 1, set)
+	inst.uncompressed.Add(ctx, s.UncompressedSize, set)
+	inst.compressed.Add(ctx, s.CompressedSize, set)
+	if s.Encoding == "" {
+		return
+	}
+	inst.duration.Record(ctx, s.Duration.Seconds(), set)
+	if s.UncompressedSize > 0 {
+		inst.ratio.Record(ctx, float64(s.CompressedSize)/float64(s.UncompressedSize), set)
+	}
+}
+
+// annotate adds the statistics of a compressed response to span.
+func annotate(span trace.Span, s compress.Stats) {
+	if s.Encoding == "" || !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(
+		EncodingKey.String(string(s.Encoding)),
+		LevelKey.Int(s.Level),
+		UncompressedSizeKey.Int64(s.UncompressedSize),
+		CompressedSizeKey.Int64(s.CompressedSize),
+		DurationKey.Float64(s.Duration.Seconds()),
+	)
+}
@@ -0,0 +1,109 @@
+package otelcompress
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/goroute/compress"
+	"github.com/goroute/route"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mw, err := New(MeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))))
+	if !assert.NoError(t, err) {
+		return
+	}
+	mux := route.NewServeMux()
+	mux.Use(mw)
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, strings.Repeat("test", 100))
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, "gzip")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var rm metricdata.ResourceMetrics
+	if !assert.NoError(t, reader.Collect(context.Background(), &rm)) || !assert.Len(t, rm.ScopeMetrics, 1) {
+		return
+	}
+	metrics := make(map[string]metricdata.Aggregation)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m.Data
+	}
+
+	responses := metrics["compress.responses"].(metricdata.Sum[int64])
+	counts := make(map[string]int64)
+	for _, dp := range responses.DataPoints {
+		encoding, _ := dp.Attributes.Value(EncodingKey)
+		contentType, _ := dp.Attributes.Value(ContentTypeKey)
+		assert.Equal(t, "text/plain", contentType.AsString())
+		counts[encoding.AsString()] += dp.Value
+	}
+	assert.Equal(t, map[string]int64{"gzip": 1, "identity": 1}, counts)
+
+	uncompressed := metrics["compress.uncompressed_size"].(metricdata.Sum[int64])
+	var total int64
+	for _, dp := range uncompressed.DataPoints {
+		total += dp.Value
+	}
+	assert.Equal(t, int64(800), total)
+
+	ratio := metrics["compress.ratio"].(metricdata.Histogram[float64])
+	if assert.Len(t, ratio.DataPoints, 1) {
+		assert.Equal(t, uint64(1), ratio.DataPoints[0].Count)
+		assert.True(t, ratio.DataPoints[0].Sum < 1)
+	}
+	duration := metrics["compress.duration"].(metricdata.Histogram[float64])
+	assert.Len(t, duration.DataPoints, 1)
+
+	// Invalid options of compress are returned rather than panicking.
+	_, err = New(Compress(compress.Level(42)))
+	assert.ErrorIs(t, err, compress.ErrInvalidLevel)
+}
+
+func TestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+	mw, err := New(MeterProvider(noop.NewMeterProvider()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	mux := route.NewServeMux()
+	mux.Use(func(c route.Context, next route.HandlerFunc) error {
+		ctx, span := tracer.Start(c.Request().Context(), "request")
+		defer span.End()
+		c.SetRequest(c.Request().WithContext(ctx))
+		return next(c)
+	})
+	mux.Use(mw)
+	mux.GET("/", func(c route.Context) error {
+		return c.String(http.StatusOK, strings.Repeat("test", 100))
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(route.HeaderAcceptEncoding, "gzip")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	attrs := attribute.NewSet(spans[0].Attributes()...)
+	encoding, _ := attrs.Value(EncodingKey)
+	assert.Equal(t, "gzip", encoding.AsString())
+	size, _ := attrs.Value(UncompressedSizeKey)
+	assert.Equal(t, int64(400), size.AsInt64())
+	assert.True(t, attrs.HasValue(CompressedSizeKey))
+	assert.True(t, attrs.HasValue(DurationKey))
+}
@@ -0,0 +1,31 @@
+package compress
+
+import "compress/gzip"
+
+// Development returns options for local development, starting from the
+// default options: the fastest level, so that responses are still compressed
+// as in production, and DebugHeader on to see how each one was handled.
+func Development() Options {
+	opts := GetDefaultOptions()
+	opts.Level = gzip.BestSpeed
+	opts.DebugHeader = true
+	return opts
+}
+
+// Production returns options for production, starting from the default
+// options: the balanced default level, a MinLength under which gzip costs
+// more than it saves, and ExcludedContentTypes listing formats that are
+// compressed already.
+func Production() Options {
+	opts := GetDefaultOptions()
+	opts.Level = gzip.DefaultCompression
+	opts.MinLength = 1024
+	opts.ExcludedContentTypes = []string{
+		"image/avif", "image/gif", "image/jpeg", "image/png", "image/webp",
+		"audio/*", "video/*",
+		"font/woff", "font/woff2",
+		"application/gzip", "application/x-gzip", "application/zip",
+		"application/zstd", "application/x-7z-compressed", "application/x-bzip2",
+	}
+	return opts
+}
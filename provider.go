@@ -0,0 +1,183 @@
+package compress
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/goroute/route"
+)
+
+// OptionsKey is the context key of options overriding those of the
+// middleware for a request, as set by SetOptions.
+const OptionsKey = "compress.options"
+
+// SetOptions makes the middleware use opts for the request of c, for example
+// from an upstream middleware choosing them by the plan of the caller. It
+// takes precedence over the Provider option and must be called before the
+// middleware runs. Like with Provider, middleware is built once per pointer,
+// for at most maxProviderOptions pointers, so pass the same pointer for the
+// same settings.
+func SetOptions(c route.Context, opts *Options) {
+	c.Set(OptionsKey, opts)
+}
+
+// OptionsFromContext returns the options set with SetOptions for the request
+// of c, or nil if there are none.
+func OptionsFromContext(c route.Context) *Options {
+	opts, _ := c.Get(OptionsKey).(*Options)
+	return opts
+}
+
+// HostOptions maps hosts to their options, for the PerHost option. Each
+// entry decoded from JSON or YAML starts from GetDefaultOptions, so that the
+// fields it leaves out keep their default rather than their zero value,
+// which would for example turn MaxBufferSize and SniffLength off and the
+// level to gzip.NoCompression: {"a.com": {"level": 5}} changes only the
+// level for a.com. Decoding replaces the entries held before.
+type HostOptions map[string]Options
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (h *HostOptions) UnmarshalJSON(b []byte) error {
+	var entries map[string]hostEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	h.set(entries)
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface of
+// gopkg.in/yaml.v2, which gopkg.in/yaml.v3 supports too.
+func (h *HostOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entries map[string]hostEntry
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+	h.set(entries)
+	return nil
+}
+
+func (h *HostOptions) set(entries map[string]hostEntry) {
+	if entries == nil {
+		*h = nil
+		return
+	}
+	hosts := make(HostOptions, len(entries))
+	for host, opts := range entries {
+		hosts[host] = Options(opts)
+	}
+	*h = hosts
+}
+
+// hostEntry decodes an entry of HostOptions over GetDefaultOptions.
+type hostEntry Options
+
+func (e *hostEntry) UnmarshalJSON(b []byte) error {
+	opts := GetDefaultOptions()
+	if err := json.Unmarshal(b, &opts); err != nil {
+		return err
+	}
+	*e = hostEntry(opts)
+	return nil
+}
+
+func (e *hostEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	opts := GetDefaultOptions()
+	if err := unmarshal(&opts); err != nil {
+		return err
+	}
+	*e = hostEntry(opts)
+	return nil
+}
+
+// maxProviderOptions bounds the middleware built for the options set with
+// SetOptions or returned by Provider, one per pointer: a provider allocating
+// options per request would otherwise build, and keep, middleware for each.
+const maxProviderOptions = 1024
+
+// newMiddleware returns Gzip middleware for opts that applies the options
+// set with SetOptions, returned by the Provider of opts or set for the host
+// in PerHost, falling back to opts.
+func newMiddleware(opts Options) route.MiddlewareFunc {
+	provider := opts.Provider
+	hosts := make(map[string]route.MiddlewareFunc, len(opts.PerHost))
+	for host, o := range opts.PerHost {
+		o.Provider, o.PerHost = nil, nil
+		hosts[normalizeHost(host)] = newGzip(o)
+	}
+	opts.Provider, opts.PerHost = nil, nil
+	fallback := newGzip(opts)
+	var (
+		mu    sync.Mutex
+		built sync.Map // *Options to route.MiddlewareFunc
+		n     int      // entries of built
+	)
+	return func(c route.Context, next route.HandlerFunc) error {
+		p := OptionsFromContext(c)
+		if p == nil && provider != nil {
+			p = provider(c)
+		}
+		if p == nil {
+			if mw := hostMiddleware(hosts, c.Request().Host); mw != nil {
+				return mw(c, next)
+			}
+			return fallback(c, next)
+		}
+		if mw, ok := built.Load(p); ok {
+			return mw.(route.MiddlewareFunc)(c, next)
+		}
+		mu.Lock()
+		mw, ok := built.Load(p)
+		if !ok {
+			if n == maxProviderOptions {
+				mu.Unlock()
+				return fmt.Errorf("%w: more than %d distinct *Options from Provider or SetOptions, which must return the same pointer for the same settings", ErrInvalidOption, maxProviderOptions)
+			}
+			o := *p
+			o.Provider = nil
+			if err := o.Validate(); err != nil {
+				mu.Unlock()
+				return err
+			}
+			mw = newGzip(o)
+			built.Store(p, mw)
+			n++
+		}
+		mu.Unlock()
+		return mw.(route.MiddlewareFunc)(c, next)
+	}
+}
+
+// hostMiddleware returns the middleware of hosts for host, the Host header
+// of a request: the entry of the host, or else of the closest wildcard
+// domain. It returns nil if there is none.
+func hostMiddleware(hosts map[string]route.MiddlewareFunc, host string) route.MiddlewareFunc {
+	if len(hosts) == 0 {
+		return nil
+	}
+	host = normalizeHost(host)
+	if mw, ok := hosts[host]; ok {
+		return mw
+	}
+	for {
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return nil
+		}
+		host = host[i+1:]
+		if mw, ok := hosts["*."+host]; ok {
+			return mw
+		}
+	}
+}
+
+// normalizeHost lower-cases host and strips its port and trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,44 @@
+package compress
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/goroute/route"
+)
+
+// Proxy returns a handler that forwards requests to target, for middleware
+// and handlers that need the plaintext body of proxied responses. The
+// Accept-Encoding of the client is not forwarded: a Transport asks the
+// upstream for compressed responses and decodes them, so that modify, if not
+// nil, reads the body decoded, and the Gzip middleware compresses the
+// result for the client. modify may replace the body; responses reach it
+// without Content-Length once decoded. Responses to range requests are
+// passed through encoded, as Transport leaves them.
+func Proxy(target *url.URL, modify func(*http.Response) error) route.HandlerFunc {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			r.Out.Header.Del(route.HeaderAcceptEncoding)
+		},
+		Transport:      new(Transport),
+		ModifyResponse: modify,
+	}
+	return func(c route.Context) error {
+		proxy.ServeHTTP(proxyWriter{c.Response()}, c.Request())
+		return nil
+	}
+}
+
+// proxyWriter hides the CloseNotify method of route.Response, which panics
+// if the underlying writer does not implement http.CloseNotifier, from
+// httputil.ReverseProxy. Flushes still reach the response through Unwrap.
+type proxyWriter struct {
+	http.ResponseWriter
+}
+
+func (w proxyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,145 @@
+package compress
+
+import (
+	"encoding"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"reflect"
+
+	"github.com/goroute/route"
+)
+
+var (
+	jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// JSON sends v as a JSON response with status code, like Context.JSON, but
+// writes it into the compressor as it is encoded instead of marshaling the
+// whole body first. Slices and arrays are encoded one element at a time, so
+// that only one element is held in memory on top of the compressor; other
+// values are encoded in one piece, as encoding/json does. The output is the
+// same as Context.JSON, indented if the request has a "pretty" query
+// parameter.
+//
+// The status is sent before encoding starts: an error encoding an element
+// cuts the body short and is returned for the caller to log.
+func JSON(c route.Context, code int, v interface{}) error {
+	indent := ""
+	if _, pretty := c.QueryParams()["pretty"]; pretty {
+		indent = "  "
+	}
+	rv := reflect.ValueOf(v)
+	if !streamable(rv) {
+		b, err := marshalJSON(v, "", indent)
+		if err != nil {
+			return err
+		}
+		startRender(c, code, route.MIMEApplicationJSONCharsetUTF8)
+		_, err = c.Response().Write(b)
+		return err
+	}
+	startRender(c, code, route.MIMEApplicationJSONCharsetUTF8)
+	w := c.Response()
+	if rv.Len() == 0 {
+		_, err := io.WriteString(w, "[]")
+		return err
+	}
+	// Elements are indented one level, as inside the array.
+	open, sep, end := "[", ",", "]"
+	if indent != "" {
+		open, sep, end = "[\n"+indent, ",\n"+indent, "\n]"
+	}
+	for i := 0; i < rv.Len(); i++ {
+		// Slice elements are addressable, so encoding/json uses their
+		// pointer methods too.
+		e := rv.Index(i)
+		if e.CanAddr() {
+			e = e.Addr()
+		}
+		b, err := marshalJSON(e.Interface(), indent, indent)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			_, err = io.WriteString(w, open)
+		} else {
+			_, err = io.WriteString(w, sep)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, end)
+	return err
+}
+
+// marshalJSON marshals v, indented if indent is not empty.
+func marshalJSON(v interface{}, prefix, indent string) ([]byte, error) {
+	if indent == "" {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, prefix, indent)
+}
+
+// streamable reports whether JSON encodes v one element at a time: v must be
+// a non-nil slice or an array that encoding/json encodes as a JSON array.
+func streamable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return false
+		}
+	case reflect.Array:
+	default:
+		return false
+	}
+	t := v.Type()
+	if t.Elem().Kind() == reflect.Uint8 {
+		// Byte slices and arrays are base64 strings.
+		return false
+	}
+	for _, t := range []reflect.Type{t, reflect.PointerTo(t)} {
+		if t.Implements(jsonMarshaler) || t.Implements(textMarshaler) {
+			return false
+		}
+	}
+	return true
+}
+
+// XML sends v as an XML response with status code, with the XML header. The
+// encoder writes into the compressor as it goes, so the body is never held
+// in memory whole. The status is sent before encoding starts: an error cuts
+// the body short and is returned for the caller to log.
+func XML(c route.Context, code int, v interface{}) error {
+	startRender(c, code, route.MIMEApplicationXMLCharsetUTF8)
+	if _, err := io.WriteString(c.Response(), xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(c.Response()).Encode(v)
+}
+
+// Render renders the template name with data using renderer and sends it as
+// an HTML response with status code, like Context.Render, but writes the
+// output into the compressor as the template executes instead of buffering
+// it. The status is sent before the template executes: an error cuts the
+// page short and is returned for the caller to log, so templates that may
+// fail halfway are better rendered with Context.Render.
+func Render(c route.Context, code int, renderer route.Renderer, name string, data interface{}) error {
+	startRender(c, code, route.MIMETextHTMLCharsetUTF8)
+	return renderer.Render(c.Response(), name, data, c)
+}
+
+// startRender sets the Content-Type, unless the handler did, and sends the
+// status.
+func startRender(c route.Context, code int, contentType string) {
+	h := c.Response().Header()
+	if h.Get(route.HeaderContentType) == "" {
+		h.Set(route.HeaderContentType, contentType)
+	}
+	c.Response().WriteHeader(code)
+}
@@ -0,0 +1,13 @@
+package compress
+
+import "hash/fnv"
+
+// inRollout reports whether the client identified by key is among the
+// percent of clients in the rollout. Clients are placed in one of 10000
+// buckets by a hash of their key, and the buckets below percent hundredths
+// are in, so raising percent only adds clients.
+func inRollout(key string, percent float64) bool {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return float64(h.Sum32()%10000) < percent*100
+}
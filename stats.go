@@ -0,0 +1,400 @@
+package compress
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goroute/route"
+)
+
+// Context keys under which the middleware stores the statistics of a
+// response once the handler has returned. Besides the Stats, the most useful
+// fields are stored as plain values so that access loggers can pick them up
+// with c.Get.
+const (
+	// StatsKey holds the Stats of the response.
+	StatsKey = "compress.stats"
+	// EncodingKey holds the content coding applied as an Encoding,
+	// EncodingIdentity if the body was not compressed.
+	EncodingKey = "compress.encoding"
+	// RatioKey holds the compressed to uncompressed size ratio as a
+	// float64. It is not set for responses without body.
+	RatioKey = "compress.ratio"
+	// DurationKey holds the time spent compressing as a time.Duration.
+	DurationKey = "compress.duration"
+	// SkipReasonKey holds the SkipReason of the response, 0 if it was
+	// compressed.
+	SkipReasonKey = "compress.skip_reason"
+)
+
+// SensitiveKey is the context key that marks a response as sensitive when set
+// to true, as MarkSensitive does. Such responses are sent uncompressed.
+const SensitiveKey = "compress.sensitive"
+
+// Stats describes the body of a response that went through the middleware.
+// route's Response.Size counts the bytes written by the handler, before
+// compression; Stats also has the number of bytes sent to the client.
+type Stats struct {
+	// Encoding is the content coding applied to the body, empty if it was
+	// sent as written.
+	Encoding Encoding
+	// Level is the compression level used, 0 if the body was not compressed.
+	Level int
+	// UncompressedSize is the number of body bytes written by the handler.
+	UncompressedSize int64
+	// CompressedSize is the number of body bytes produced for the client.
+	// It equals UncompressedSize when the body was not compressed.
+	CompressedSize int64
+	// Duration is the time spent compressing the body. Unless the response
+	// is buffered it includes the time taken to send the compressed bytes.
+	Duration time.Duration
+	// ContentType is the media type of the response, without parameters.
+	ContentType string
+	// Shadow is set when the body was only compressed for measurement, in
+	// shadow mode, and sent as written.
+	Shadow bool
+}
+
+// GetStats returns the Stats stored by the middleware for the response of c.
+// It is meant for middleware registered before this one, after their next
+// handler has returned.
+func GetStats(c route.Context) (Stats, bool) {
+	s, ok := c.Get(StatsKey).(Stats)
+	return s, ok
+}
+
+// GetSkipReason returns why the response of c was not compressed, 0 if it
+// was. ok is false if the middleware has not completed the response.
+func GetSkipReason(c route.Context) (reason SkipReason, ok bool) {
+	reason, ok = c.Get(SkipReasonKey).(SkipReason)
+	return
+}
+
+// store sets s, its fields and reason on c under the context keys.
+func store(c route.Context, s Stats, reason SkipReason) {
+	c.Set(StatsKey, s)
+	c.Set(SkipReasonKey, reason)
+	if s.Encoding != "" {
+		c.Set(EncodingKey, s.Encoding)
+	} else {
+		c.Set(EncodingKey, EncodingIdentity)
+	}
+	if s.UncompressedSize > 0 {
+		c.Set(RatioKey, float64(s.CompressedSize)/float64(s.UncompressedSize))
+	}
+	c.Set(DurationKey, s.Duration)
+}
+
+// stats returns the statistics of the response written so far.
+func (w *ResponseWriter) stats() Stats {
+	s := Stats{UncompressedSize: w.size, CompressedSize: w.wire, Duration: w.elapsed}
+	if w.encoding != "" {
+		s.Encoding = w.encoding
+		s.Level = w.level
+		s.Shadow = w.shadow
+	}
+	return s
+}
+
+// debugValue formats s for the X-Compress header, as in
+// "gzip;level=5;ratio=0.21;dur=1.8ms".
+func debugValue(s Stats) string {
+	v := string(s.Encoding) + ";level=" + strconv.Itoa(s.Level)
+	if s.UncompressedSize > 0 {
+		v += ";ratio=" + strconv.FormatFloat(float64(s.CompressedSize)/float64(s.UncompressedSize), 'f', 2, 64)
+	}
+	return v + ";dur=" + strconv.FormatFloat(float64(s.Duration)/float64(time.Millisecond), 'f', 1, 64) + "ms"
+}
+
+// SkipReason tells why a response was not compressed. The zero value means
+// it was.
+type SkipReason int
+
+// Skip reasons
+const (
+	// SkipSkipper means the Skipper returned true.
+	SkipSkipper SkipReason = iota + 1
+	// SkipUpgrade means the request or response upgraded the connection to
+	// another protocol.
+	SkipUpgrade
+	// SkipNotAccepted means the client did not accept a supported encoding.
+	SkipNotAccepted
+	// SkipNoBody means the response had no body, either because of its
+	// status or because the handler wrote none.
+	SkipNoBody
+	// SkipHijacked means the handler took over the connection before
+	// writing a body.
+	SkipHijacked
+	// SkipError means the handler returned an error before the compressed
+	// response was sent, so it was dropped.
+	SkipError
+	// SkipBelowMinLength means the body was shorter than MinLength.
+	SkipBelowMinLength
+	// SkipExcludedContentType means the Content-Type of the response is
+	// listed in ExcludedContentTypes.
+	SkipExcludedContentType
+	// SkipNoTransform means the response has Cache-Control: no-transform.
+	SkipNoTransform
+	// SkipAlreadyEncoded means the handler set a Content-Encoding itself.
+	SkipAlreadyEncoded
+	// SkipNotSampled means the response was left out of the sample measured
+	// in shadow mode, or its client out of the rollout of RolloutPercent.
+	SkipNotSampled
+	// SkipCredentials means the request carried credentials and
+	// SkipAuthenticated was set.
+	SkipCredentials
+	// SkipSensitive means the response was marked as sensitive.
+	SkipSensitive
+	// SkipResponseCookies means the response sets cookies and SkipSetCookie
+	// was set.
+	SkipResponseCookies
+	// SkipCrossSite means the request was a cross-origin one carrying
+	// credentials and SkipCrossOrigin was set.
+	SkipCrossSite
+	// SkipRateLimited means the client used up its budget in the Limiter.
+	SkipRateLimited
+	// SkipSelected means the Selector chose identity for the request.
+	SkipSelected
+)
+
+var skipReasonNames = map[SkipReason]string{
+	SkipSkipper:     "skipper",
+	SkipUpgrade:     "upgrade",
+	SkipNotAccepted: "not_accepted",
+	SkipNoBody:      "no_body",
+	SkipHijacked:    "hijacked",
+	SkipError:       "error",
+
+	SkipBelowMinLength:      "below_min_length",
+	SkipExcludedContentType: "excluded_content_type",
+	SkipNoTransform:         "no_transform",
+	SkipAlreadyEncoded:      "already_encoded",
+	SkipNotSampled:          "not_sampled",
+	SkipCredentials:         "credentials",
+	SkipSensitive:           "sensitive",
+	SkipResponseCookies:     "set_cookie",
+	SkipCrossSite:           "cross_site",
+	SkipRateLimited:         "rate_limited",
+	SkipSelected:            "selected",
+}
+
+func (r SkipReason) String() string {
+	if name, ok := skipReasonNames[r]; ok {
+		return name
+	}
+	return "none"
+}
+
+// MarshalText implements encoding.TextMarshaler, so that reasons show up by
+// name as JSON object keys.
+func (r SkipReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *SkipReason) UnmarshalText(text []byte) error {
+	for reason, name := range skipReasonNames {
+		if name == string(text) {
+			*r = reason
+			return nil
+		}
+	}
+	return fmt.Errorf("compress: unknown skip reason %q", text)
+}
+
+// Counters is a snapshot of the statistics aggregated by a Collector.
+type Counters struct {
+	// Requests is the number of responses seen.
+	Requests int64 `json:"requests"`
+	// Compressed is the number of compressed responses.
+	Compressed int64 `json:"compressed"`
+	// Skipped counts the responses that were not compressed by reason.
+	Skipped map[SkipReason]int64 `json:"skipped"`
+	// Encodings counts the compressed responses by content coding.
+	Encodings map[Encoding]int64 `json:"encodings"`
+	// BytesIn is the number of body bytes written by handlers.
+	BytesIn int64 `json:"bytes_in"`
+	// BytesOut is the number of body bytes produced for clients.
+	BytesOut int64 `json:"bytes_out"`
+	// Anomalies is the number of responses flagged by AnomalyFactor.
+	Anomalies int64 `json:"anomalies"`
+	// Durations holds the time spent compressing, in seconds, by content
+	// coding and content type family, such as "text" or "image".
+	Durations map[Encoding]map[string]Histogram `json:"durations"`
+	// Ratios holds the compressed to uncompressed size ratios by content
+	// coding and content type family.
+	Ratios map[Encoding]map[string]Histogram `json:"ratios"`
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	// Bounds are the inclusive upper bounds of the buckets, in increasing
+	// order.
+	Bounds []float64 `json:"bounds"`
+	// Counts holds the number of observations per bucket. Its last element
+	// counts those above the last bound.
+	Counts []int64 `json:"counts"`
+	// Count is the number of observations.
+	Count int64 `json:"count"`
+	// Sum is the sum of the observations.
+	Sum float64 `json:"sum"`
+}
+
+// Histogram bounds
+var (
+	durationBounds = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+	ratioBounds    = []float64{.1, .2, .3, .4, .5, .6, .7, .8, .9, 1}
+)
+
+// observe adds v to the histogram.
+func (h *Histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.Bounds, v)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += v
+}
+
+// observe adds v to the histogram of encoding and family in m, creating it
+// with bounds if needed.
+func observe(m map[Encoding]map[string]Histogram, encoding Encoding, family string, bounds []float64, v float64) {
+	byFamily, ok := m[encoding]
+	if !ok {
+		byFamily = make(map[string]Histogram)
+		m[encoding] = byFamily
+	}
+	h, ok := byFamily[family]
+	if !ok {
+		h = Histogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+	}
+	h.observe(v)
+	byFamily[family] = h
+}
+
+// cloneHistograms returns a deep copy of m.
+func cloneHistograms(m map[Encoding]map[string]Histogram) map[Encoding]map[string]Histogram {
+	c := make(map[Encoding]map[string]Histogram, len(m))
+	for encoding, byFamily := range m {
+		c[encoding] = make(map[string]Histogram, len(byFamily))
+		for family, h := range byFamily {
+			h.Counts = append([]int64(nil), h.Counts...)
+			c[encoding][family] = h
+		}
+	}
+	return c
+}
+
+// Collector aggregates the statistics of the responses handled by the
+// middleware. It is safe for concurrent use and may be shared by several
+// middleware instances.
+type Collector struct {
+	mu       sync.Mutex
+	counters Counters
+}
+
+// NewCollector returns an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{
+		counters: Counters{
+			Skipped:   make(map[SkipReason]int64),
+			Encodings: make(map[Encoding]int64),
+			Durations: make(map[Encoding]map[string]Histogram),
+			Ratios:    make(map[Encoding]map[string]Histogram),
+		},
+	}
+}
+
+// Stats returns a snapshot of the counters.
+func (c *Collector) Stats() Counters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.counters
+	s.Skipped = make(map[SkipReason]int64, len(c.counters.Skipped))
+	for k, v := range c.counters.Skipped {
+		s.Skipped[k] = v
+	}
+	s.Encodings = make(map[Encoding]int64, len(c.counters.Encodings))
+	for k, v := range c.counters.Encodings {
+		s.Encodings[k] = v
+	}
+	s.Durations = cloneHistograms(c.counters.Durations)
+	s.Ratios = cloneHistograms(c.counters.Ratios)
+	return s
+}
+
+// Publish exports the counters as the expvar variable name, so that they
+// show up in /debug/vars. Like expvar.Publish, it panics if the name is
+// already in use.
+func (c *Collector) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return c.Stats()
+	}))
+}
+
+// StatsHandler returns a handler that replies with the counters of collector
+// as JSON. Mount it on an internal route, as it reveals traffic volumes.
+func StatsHandler(collector *Collector) route.HandlerFunc {
+	return func(c route.Context) error {
+		c.Response().Header().Set(headerCacheControl, "no-store")
+		return c.JSON(http.StatusOK, collector.Stats())
+	}
+}
+
+// record adds a response to the counters. A nil Collector records nothing.
+func (c *Collector) record(s Stats, reason SkipReason) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters.Requests++
+	c.counters.BytesIn += s.UncompressedSize
+	c.counters.BytesOut += s.CompressedSize
+	if reason != 0 {
+		c.counters.Skipped[reason]++
+		return
+	}
+	c.counters.Compressed++
+	c.counters.Encodings[s.Encoding]++
+	family := "other"
+	if i := strings.IndexByte(s.ContentType, '/'); i > 0 {
+		family = s.ContentType[:i]
+	}
+	observe(c.counters.Durations, s.Encoding, family, durationBounds, s.Duration.Seconds())
+	if s.UncompressedSize > 0 {
+		observe(c.counters.Ratios, s.Encoding, family, ratioBounds, float64(s.CompressedSize)/float64(s.UncompressedSize))
+	}
+}
+
+// anomaly counts a response flagged by anomaly detection. A nil Collector
+// records nothing.
+func (c *Collector) anomaly() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counters.Anomalies++
+}
+
+// skipReason returns why the response was not compressed, 0 if it was.
+func (w *ResponseWriter) skipReason() SkipReason {
+	switch {
+	case w.encoding != "":
+		return 0
+	case w.skipped != 0:
+		return w.skipped
+	case w.hijacked:
+		return SkipHijacked
+	case w.identity:
+		return SkipNotAccepted
+	case isUpgrade(w.Header()):
+		return SkipUpgrade
+	}
+	return SkipNoBody
+}
@@ -0,0 +1,136 @@
+package compress
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// errTrailingData is returned for bytes written after the end of an encoded
+// body.
+var errTrailingData = errors.New("compress: data after the end of the encoded body")
+
+// decoder decodes a body encoded with gzip or deflate as it is written,
+// passing the result to dst. It holds no more than a chunk of input and the
+// window of the decompressor. Write returns once everything that can be
+// decoded from the input so far has gone to dst, so dst is never called
+// concurrently with the writer.
+type decoder struct {
+	chunks chan []byte
+	acks   chan struct{}
+	done   chan error
+	// cur and started belong to the decoding goroutine.
+	cur     []byte
+	started bool
+	// written is set once input has been written; finished once done has
+	// been received, with err its value.
+	written  bool
+	finished bool
+	err      error
+}
+
+// decodable reports whether the content coding ce can be decoded: gzip,
+// deflate, or a coding registered with RegisterCodec.
+func decodable(ce string) bool {
+	coding := Encoding(strings.ToLower(strings.TrimSpace(ce)))
+	switch coding {
+	case EncodingGzip, "x-gzip", EncodingDeflate:
+		return true
+	case EncodingIdentity, "":
+		return false
+	}
+	codec, ok := registeredCodec(coding)
+	return ok && codec.NewReader != nil
+}
+
+// newDecoder returns a decoder for the content coding ce, one for which
+// decodable is true.
+func newDecoder(ce string, dst io.Writer) *decoder {
+	d := &decoder{
+		chunks: make(chan []byte),
+		acks:   make(chan struct{}),
+		done:   make(chan error, 1),
+	}
+	go func() {
+		r, err := NewReader(ce, readerFunc(d.read))
+		if err == nil {
+			_, err = io.Copy(dst, r)
+		}
+		d.done <- err
+	}()
+	return d
+}
+
+// read feeds the decompressor with the chunks written, acknowledging each
+// once it has been consumed.
+func (d *decoder) read(p []byte) (int, error) {
+	if len(d.cur) == 0 {
+		if d.started {
+			d.acks <- struct{}{}
+		}
+		d.started = true
+		chunk, ok := <-d.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		d.cur = chunk
+	}
+	n := copy(p, d.cur)
+	d.cur = d.cur[n:]
+	return n, nil
+}
+
+func (d *decoder) Write(b []byte) (int, error) {
+	if d.finished {
+		if d.err != nil {
+			return 0, d.err
+		}
+		return 0, errTrailingData
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	d.written = true
+	select {
+	case d.chunks <- b:
+	case err := <-d.done:
+		d.finish(err)
+		return d.Write(b)
+	}
+	select {
+	case <-d.acks:
+		return len(b), nil
+	case err := <-d.done:
+		d.finish(err)
+		if err != nil {
+			return 0, err
+		}
+		// The body ended within b.
+		return len(b), nil
+	}
+}
+
+// Close ends the input and waits for the rest of the body to be decoded. An
+// empty body is not an error.
+func (d *decoder) Close() error {
+	if !d.finished {
+		close(d.chunks)
+		d.finish(<-d.done)
+		if !d.written {
+			d.err = nil
+		}
+	}
+	return d.err
+}
+
+func (d *decoder) finish(err error) {
+	d.finished = true
+	d.err = err
+}
+
+// readerFunc adapts a function to io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
@@ -0,0 +1,127 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/goroute/route"
+)
+
+// transportEncodings is the Accept-Encoding value sent by Transport, the
+// codings it can decode with the standard library.
+const transportEncodings = string(EncodingGzip) + ", " + string(EncodingDeflate)
+
+// Transport is an http.RoundTripper that asks for compressed responses and
+// decodes them, like http.Transport does for gzip alone. Decoded responses
+// lose their Content-Encoding and Content-Length headers and have
+// Uncompressed set. Responses to requests that set Accept-Encoding
+// themselves, or a Range, are left encoded.
+type Transport struct {
+	// Base sends the requests.
+	// Optional. Default value http.DefaultTransport.
+	Base http.RoundTripper
+
+	// CompressRequests sends request bodies gzip-encoded, unless the
+	// request sets Content-Encoding itself. The server must accept
+	// compressed requests. Bodies are compressed while they are sent, so
+	// their length becomes unknown; if the request can be replayed with
+	// GetBody, the replay is compressed too.
+	// Optional. Default value false.
+	CompressRequests bool
+
+	// RequestMinLength is the Content-Length under which request bodies
+	// are sent uncompressed. Bodies of unknown length are compressed.
+	// Optional. Default value 0.
+	RequestMinLength int64
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	decode := req.Header.Get(route.HeaderAcceptEncoding) == "" && req.Header.Get(headerRange) == ""
+	encode := t.CompressRequests && req.Body != nil && req.Body != http.NoBody &&
+		req.Header.Get(route.HeaderContentEncoding) == "" &&
+		(req.ContentLength <= 0 || req.ContentLength >= t.RequestMinLength)
+	if !decode && !encode {
+		return base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	if encode {
+		req.Body = compressBody(req.Body)
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return compressBody(body), nil
+			}
+		}
+		req.ContentLength = -1
+		req.Header.Del(route.HeaderContentLength)
+		req.Header.Set(route.HeaderContentEncoding, string(EncodingGzip))
+	}
+	if !decode {
+		return base.RoundTrip(req)
+	}
+	req.Header.Set(route.HeaderAcceptEncoding, transportEncodings)
+	res, err := base.RoundTrip(req)
+	if err != nil || req.Method == http.MethodHead || res.Body == nil || res.Body == http.NoBody {
+		return res, err
+	}
+	ce := res.Header.Get(route.HeaderContentEncoding)
+	if !decodable(ce) {
+		return res, nil
+	}
+	res.Body = &decodingBody{body: res.Body, decode: func(r io.Reader) (io.Reader, error) {
+		return NewReader(ce, r)
+	}}
+	res.Header.Del(route.HeaderContentEncoding)
+	res.Header.Del(route.HeaderContentLength)
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return res, nil
+}
+
+// compressBody returns body gzip-encoded. It is compressed as it is read and
+// closed once read, or once the result is closed.
+func compressBody(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, body)
+		if err == nil {
+			err = zw.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decodingBody decodes a response body, creating the decoder on first read
+// so that an empty body only fails if it is read.
+type decodingBody struct {
+	body   io.ReadCloser
+	decode func(io.Reader) (io.Reader, error)
+	r      io.Reader
+	err    error
+}
+
+func (b *decodingBody) Read(p []byte) (int, error) {
+	if b.r == nil && b.err == nil {
+		b.r, b.err = b.decode(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.r.Read(p)
+}
+
+func (b *decodingBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,247 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrMessageTooLarge is returned by WebSocketDeflate.Decompress for messages
+// that decompress to more than MaxMessageSize bytes.
+var ErrMessageTooLarge = errors.New("compress: websocket message too large")
+
+const (
+	headerSecWebSocketExtensions = "Sec-WebSocket-Extensions"
+
+	// permessageDeflate is the name of the extension (RFC 7692).
+	permessageDeflate = "permessage-deflate"
+
+	// maxWindowBits is the only window size the flate package uses.
+	maxWindowBits = 15
+	windowSize    = 1 << maxWindowBits
+
+	// deflateTail ends each compressed message: the empty stored block of a
+	// sync flush, which senders strip and receivers add back.
+	deflateTail = "\x00\x00\xff\xff"
+)
+
+// flateWriters pools flate writers by level, from flate.HuffmanOnly to
+// flate.BestCompression.
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// WebSocketDeflate compresses and decompresses the messages of a WebSocket
+// connection that agreed on the permessage-deflate extension (RFC 7692). It
+// applies the extension to message payloads; framing, and setting the RSV1
+// bit on compressed messages, is left to the handler that hijacked the
+// connection. Compress and Decompress may be called concurrently, as
+// reading and writing a connection usually are.
+type WebSocketDeflate struct {
+	// ServerNoContextTakeover is set when each message sent is compressed
+	// on its own, as the client asked.
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover is set when the client compresses each
+	// message on its own.
+	ClientNoContextTakeover bool
+
+	// MaxMessageSize limits the decompressed size of the messages received.
+	// Optional. Default value 0, no limit.
+	MaxMessageSize int64
+
+	level     int
+	minLength int
+
+	wmu sync.Mutex
+	fw  *flate.Writer
+	buf bytes.Buffer
+
+	rmu  sync.Mutex
+	fr   io.ReadCloser
+	dict []byte
+}
+
+// WebSocketNegotiator accepts the permessage-deflate extension in WebSocket
+// handshakes, with options validated once for all of them.
+type WebSocketNegotiator struct {
+	opts Options
+}
+
+// NewWebSocketNegotiator returns a WebSocketNegotiator. The options configure
+// compression like they do for Gzip middleware: Level is the compression
+// level and messages shorter than MinLength are sent uncompressed. It returns
+// the error of Validate if the options are invalid.
+func NewWebSocketNegotiator(options ...Option) (*WebSocketNegotiator, error) {
+	opts := GetDefaultOptions()
+	for _, opt := range options {
+		opt(&opts)
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &WebSocketNegotiator{opts: opts}, nil
+}
+
+// Negotiate picks the first permessage-deflate offer in the
+// Sec-WebSocket-Extensions headers of a WebSocket handshake request that it
+// can accept. Offers limiting the window of the server below 32 KiB are
+// declined, as the flate package cannot shrink it. It returns false if there
+// is no acceptable offer, or if Disabled is set.
+//
+// The handler sends Header in the Sec-WebSocket-Extensions header of its
+// handshake response, and calls Close once the connection is closed.
+func (n *WebSocketNegotiator) Negotiate(h http.Header) (*WebSocketDeflate, bool) {
+	if n.opts.Disabled {
+		return nil, false
+	}
+	for _, v := range h.Values(headerSecWebSocketExtensions) {
+		for _, ext := range strings.Split(v, ",") {
+			if d, ok := parseDeflateOffer(ext); ok {
+				d.level = n.opts.Level
+				d.minLength = n.opts.MinLength
+				return d, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// parseDeflateOffer returns the parameters agreed for ext, if it is an
+// acceptable permessage-deflate offer.
+func parseDeflateOffer(ext string) (*WebSocketDeflate, bool) {
+	params := strings.Split(ext, ";")
+	if !strings.EqualFold(strings.TrimSpace(params[0]), permessageDeflate) {
+		return nil, false
+	}
+	d := new(WebSocketDeflate)
+	seen := make(map[string]bool)
+	for _, param := range params[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[name] {
+			return nil, false
+		}
+		seen[name] = true
+		switch name {
+		case "server_no_context_takeover":
+			d.ServerNoContextTakeover = true
+		case "client_no_context_takeover":
+			d.ClientNoContextTakeover = true
+		case "server_max_window_bits":
+			if n, err := strconv.Atoi(value); err != nil || n != maxWindowBits {
+				return nil, false
+			}
+		case "client_max_window_bits":
+			// Decompression handles any window: the client may keep its
+			// own.
+			if value != "" {
+				if n, err := strconv.Atoi(value); err != nil || n < 8 || n > maxWindowBits {
+					return nil, false
+				}
+			}
+		default:
+			return nil, false
+		}
+	}
+	return d, true
+}
+
+// Header returns the value of the Sec-WebSocket-Extensions header of the
+// handshake response.
+func (d *WebSocketDeflate) Header() string {
+	v := permessageDeflate
+	if d.ServerNoContextTakeover {
+		v += "; server_no_context_takeover"
+	}
+	if d.ClientNoContextTakeover {
+		v += "; client_no_context_takeover"
+	}
+	return v
+}
+
+// Compress returns the payload of a message to send. compressed reports
+// whether it is compressed, in which case the frame must have RSV1 set;
+// payloads shorter than MinLength are returned as is. The result is valid
+// until the next call.
+func (d *WebSocketDeflate) Compress(payload []byte) (out []byte, compressed bool, err error) {
+	if len(payload) < d.minLength {
+		return payload, false, nil
+	}
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	d.buf.Reset()
+	if d.fw == nil {
+		pool := &flateWriters[d.level-flate.HuffmanOnly]
+		if v := pool.Get(); v != nil {
+			d.fw = v.(*flate.Writer)
+			d.fw.Reset(&d.buf)
+		} else if d.fw, err = flate.NewWriter(&d.buf, d.level); err != nil {
+			return nil, false, err
+		}
+	}
+	if _, err := d.fw.Write(payload); err != nil {
+		return nil, false, err
+	}
+	if err := d.fw.Flush(); err != nil {
+		return nil, false, err
+	}
+	if d.ServerNoContextTakeover {
+		d.putWriter()
+	}
+	return bytes.TrimSuffix(d.buf.Bytes(), []byte(deflateTail)), true, nil
+}
+
+// Decompress returns the payload of a compressed message received, one
+// whose first frame had RSV1 set.
+func (d *WebSocketDeflate) Decompress(payload []byte) ([]byte, error) {
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+	// A final empty stored block ends the stream after the message.
+	r := io.MultiReader(bytes.NewReader(payload), strings.NewReader(deflateTail+"\x01\x00\x00\xff\xff"))
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(r, d.dict)
+	} else if err := d.fr.(flate.Resetter).Reset(r, d.dict); err != nil {
+		return nil, err
+	}
+	var src io.Reader = d.fr
+	if d.MaxMessageSize > 0 {
+		src = io.LimitReader(src, d.MaxMessageSize+1)
+	}
+	out, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if d.MaxMessageSize > 0 && int64(len(out)) > d.MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	if !d.ClientNoContextTakeover {
+		d.dict = append(d.dict, out...)
+		if len(d.dict) > windowSize {
+			d.dict = append(d.dict[:0], d.dict[len(d.dict)-windowSize:]...)
+		}
+	}
+	return out, nil
+}
+
+// Close returns the compressor to the pool. The WebSocketDeflate must not be
+// used afterwards.
+func (d *WebSocketDeflate) Close() {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	d.putWriter()
+	d.rmu.Lock()
+	defer d.rmu.Unlock()
+	d.fr, d.dict = nil, nil
+}
+
+func (d *WebSocketDeflate) putWriter() {
+	if d.fw != nil {
+		flateWriters[d.level-flate.HuffmanOnly].Put(d.fw)
+		d.fw = nil
+	}
+}
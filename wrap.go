@@ -0,0 +1,55 @@
+package compress
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/goroute/route"
+)
+
+// Wrap returns h compressed like New would, for servers using net/http or
+// another router instead of route. Errors are reported to OnError; if no
+// response was sent yet when one occurs, the client gets 500 Internal Server
+// Error. Options using route.Context, such as Skipper, get a context carrying
+// only the request and response.
+func Wrap(h http.Handler, options ...Option) http.Handler {
+	mw := New(options...)
+	mux := route.NewServeMux()
+	next := func(c route.Context) error {
+		h.ServeHTTP(response{c.Response()}, c.Request())
+		return nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := mux.NewContext(r, w)
+		if err := mw(c, next); err != nil && !c.Response().Committed {
+			http.Error(c.Response(), http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	})
+}
+
+// response lets http.ResponseController reach the writer of a route.Response.
+type response struct {
+	*route.Response
+}
+
+func (r response) Unwrap() http.ResponseWriter {
+	return r.Response.Writer
+}
+
+// ReadFrom implements io.ReaderFrom, which route.Response lacks, so that
+// io.Copy to the response, as http.FileServer does, reaches
+// ResponseWriter.ReadFrom and the sendfile path of the server when the
+// response is not compressed. No After functions are registered on the
+// context of Wrap, so none are run.
+func (r response) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := r.Response.Writer.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{r.Response}, src)
+	}
+	if !r.Committed {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := rf.ReadFrom(src)
+	r.Size += n
+	return n, err
+}
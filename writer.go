@@ -0,0 +1,1195 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goroute/route"
+)
+
+// gzipWriters pools gzip writers by level, from gzip.HuffmanOnly to
+// gzip.BestCompression. Middleware with the same level share a pool.
+var gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+// ResponseWriter compresses the response body. The middleware installs it as
+// the writer of the response while the handler runs, so other middleware can
+// find it with GetWriter. Nothing about the response changes until the first
+// byte of the body is written: only then is Content-Encoding set and a gzip
+// writer taken from the pool.
+type ResponseWriter struct {
+	http.ResponseWriter
+	gw            *gzip.Writer
+	pool          *sync.Pool
+	level         int
+	etag          ETagStrategy
+	computeETag   bool
+	digests       []string
+	lengthHdr     string
+	statsTrailers bool
+	debug         bool
+	req           *http.Request
+	bodyless      map[int]bool
+	// identity is set when the client does not accept gzip; the writer
+	// then only observes the response.
+	identity bool
+	// minLength and excluded are the MinLength and ExcludedContentTypes
+	// options.
+	minLength int
+	excluded  []string
+	// padding and lengthPadding are the GzipPadding and LengthPadding
+	// options.
+	padding       int
+	lengthPadding int
+	skipSetCookie bool
+	// sensitive reports whether the handler marked the response with
+	// MarkSensitive.
+	sensitive func() bool
+	// sniff and sniffLength are the Sniffer and SniffLength options.
+	sniff       func(data []byte) string
+	sniffLength int
+	// checked is set once skip has been evaluated.
+	checked bool
+	// transcode is the Transcode option and codings the codings accepted
+	// by the client. dec decodes the body written, if it is encoded in a
+	// coding the client does not accept.
+	transcode   bool
+	transcoding bool
+	codings     []acceptedCoding
+	dec         *decoder
+	// flushInterval is the FlushInterval option. Once set, mu serializes
+	// the handler with the flushes of flushTimer, scheduled after a write
+	// while flushPending is set, until flushStopped. flushTook is how long
+	// the last flush of the underlying writer blocked.
+	flushInterval time.Duration
+	mu            sync.Mutex
+	flushTimer    *time.Timer
+	flushPending  bool
+	flushTook     time.Duration
+	flushStopped  bool
+	// flushEvents, flushRecords and flushPolicies are the FlushEvents,
+	// FlushRecords and FlushPolicies options, applied once flushChecked.
+	// timed is set if the timer flushes the response; boundary, if set,
+	// reports whether a write ends a unit of the stream to flush at, and
+	// last is the last byte written.
+	flushEvents   bool
+	flushRecords  bool
+	flushPolicies map[string]FlushStrategy
+	writeThrough  func() bool
+	flushChecked  bool
+	timed         bool
+	boundary      func(last byte, b []byte) bool
+	last          byte
+	// shadow compresses the body passed through into sgw, only to measure
+	// it. It is cleared if the body turns out not to be compressible.
+	shadow bool
+	sgw    *gzip.Writer
+	// vary defers adding Vary: Accept-Encoding until the status is known.
+	vary         bool
+	varyStrategy VaryStrategy
+	h2           bool
+
+	// code is the status set by the handler, 0 until WriteHeader is called.
+	code        int
+	wroteHeader bool
+	hijacked    bool
+	// size counts the uncompressed body bytes written by the handler.
+	size int64
+	// declared is the Content-Length set by the handler, -1 if none.
+	declared int64
+	// wire counts the body bytes produced for the client: the output of the
+	// gzip writer, or the body as written when it is passed through.
+	wire int64
+	// encoding is the content coding applied, set once compression starts.
+	encoding Encoding
+	// skipped is why the body is passed through, 0 if it is not.
+	skipped SkipReason
+	// pending holds the first body bytes until SniffLength and MinLength
+	// are reached.
+	pending []byte
+	// elapsed is the time spent in the gzip writer.
+	elapsed time.Duration
+	// closed is set once the gzip stream is complete.
+	closed bool
+	// err is the first error hit while compressing or sending the response.
+	err error
+	// connErr is the first error returned by the underlying writer.
+	connErr error
+	// yielded is set when an instance of the middleware nested inside this
+	// one took the response over.
+	yielded bool
+	// saved holds the headers changed before the handler ran, restored if
+	// the response is yielded.
+	saved headerSnapshot
+
+	// buf holds the compressed body while the response is buffered. It is
+	// nil once the response has been released to the client.
+	buf    *bytes.Buffer
+	maxBuf int
+}
+
+// yield hands the response over to an instance of the middleware nested
+// inside this one, such as one attached to a route group, and returns the
+// writer it wraps. It reports false if part of the response was already
+// written.
+func (w *ResponseWriter) yield() (http.ResponseWriter, bool) {
+	if w.wroteHeader || w.size > 0 || w.hijacked {
+		return nil, false
+	}
+	w.yielded = true
+	w.saved.restore()
+	return w.ResponseWriter, true
+}
+
+// headerSnapshot records the values of headers before the middleware changes
+// them, so that an instance yielding the response to a nested one leaves the
+// request and response as it found them: Accept-Encoding removed under Edge,
+// If-Match and If-None-Match rewritten for ETagSuffix, and Vary.
+type headerSnapshot struct {
+	entries [4]savedHeader
+	n       int
+}
+
+type savedHeader struct {
+	h      http.Header
+	key    string
+	values []string
+}
+
+// save records the values of the canonical key in h.
+func (s *headerSnapshot) save(h http.Header, key string) {
+	s.entries[s.n] = savedHeader{h: h, key: key, values: h[key]}
+	s.n++
+}
+
+// restore puts the recorded values back, latest change first.
+func (s *headerSnapshot) restore() {
+	for i := s.n - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if e.values == nil {
+			delete(e.h, e.key)
+		} else {
+			e.h[e.key] = e.values
+		}
+	}
+	s.n = 0
+}
+
+// writerOnly hides every method but Write, so that io.Copy does not call back
+// into ReadFrom.
+type writerOnly struct {
+	io.Writer
+}
+
+// digestAlgorithms maps the RFC 9530 algorithm keys to their hash functions.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func (w *ResponseWriter) WriteHeader(code int) {
+	w.lock()
+	defer w.unlock()
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// Informational responses precede the final one and are sent as is.
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.code = code
+	if w.identity {
+		w.writeHeader()
+		return
+	}
+	if !w.bodyAllowed(code) {
+		h := w.Header()
+		h.Del(route.HeaderContentEncoding)
+		h.Del(route.HeaderContentType)
+		h.Del(route.HeaderContentLength)
+		if code == http.StatusNotModified {
+			// A 304 describes the representation a 200 would have carried,
+			// so it gets the same validator.
+			adjustETag(h, w.etag, EncodingGzip)
+		}
+	}
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	w.lock()
+	defer w.unlock()
+	defer w.scheduleFlush()
+	if w.decoding() {
+		n, err := w.dec.Write(b)
+		return n, w.fault(OpWrite, err)
+	}
+	n, err := w.write(b)
+	if err == nil && n > 0 {
+		w.flushBoundary(b[:n])
+	}
+	return n, err
+}
+
+// write handles the body written by the handler, once decoded if needed.
+func (w *ResponseWriter) write(b []byte) (int, error) {
+	if w.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if w.gw == nil {
+		if w.passthrough() {
+			w.writeHeader()
+			n, err := w.ResponseWriter.Write(b)
+			w.size += int64(n)
+			if !w.shadow || !w.measure(b[:n]) {
+				w.wire += int64(n)
+			}
+			return n, err
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+	}
+	if err := w.req.Context().Err(); err != nil {
+		// The client is gone: stop compressing and release the writer.
+		w.abort()
+		return 0, w.fault(OpWrite, err)
+	}
+	if w.gw == nil {
+		if w.Header().Get(route.HeaderContentType) == "" {
+			if len(w.pending)+len(b) < w.sniffLength {
+				// Too short to tell the type yet.
+				w.pending = append(w.pending, b...)
+				return len(b), nil
+			}
+			w.Header().Set(route.HeaderContentType, w.detectContentType(append(w.pending[:len(w.pending):len(w.pending)], b...)))
+		}
+		if !w.checked {
+			w.checked = true
+			if w.skipped = w.skip(); w.skipped != 0 {
+				if err := w.passPending(); err != nil {
+					return 0, err
+				}
+				return w.write(b)
+			}
+		}
+		if w.Header().Get(route.HeaderContentLength) == "" && len(w.pending)+len(b) < w.minLength {
+			// Too short to tell yet whether compressing pays off.
+			w.pending = append(w.pending, b...)
+			return len(b), nil
+		}
+		if err := w.start(); err != nil {
+			return 0, w.fault(OpInit, err)
+		}
+	}
+	if w.declared >= 0 && w.size+int64(len(b)) > w.declared {
+		return 0, http.ErrContentLength
+	}
+	t := time.Now()
+	n, err := w.gw.Write(b)
+	w.elapsed += time.Since(t)
+	w.size += int64(n)
+	return n, w.fault(OpWrite, err)
+}
+
+// decoding reports whether the body written by the handler is decoded before
+// being handled. This is decided on the first write, if the Transcode option
+// is set: a body encoded with a coding the client does not accept is decoded,
+// and then compressed or not like any other.
+func (w *ResponseWriter) decoding() bool {
+	if w.transcode && !w.transcoding && !w.hijacked {
+		w.transcoding = true
+		h := w.Header()
+		ce := h.Get(route.HeaderContentEncoding)
+		coding := Encoding(strings.ToLower(strings.TrimSpace(ce)))
+		if coding == "x-gzip" {
+			coding = EncodingGzip
+		}
+		if decodable(ce) && !accepts(w.codings, coding) {
+			h.Del(route.HeaderContentEncoding)
+			h.Del(route.HeaderContentLength)
+			adjustETag(h, ETagWeaken, "")
+			w.dec = newDecoder(ce, writerFunc(w.writeDecoded))
+		}
+	}
+	return w.dec != nil
+}
+
+// stopDecoding ends the decoder, if any, dropping its output, so that its
+// goroutine exits.
+func (w *ResponseWriter) stopDecoding() {
+	if w.dec != nil {
+		dec := w.dec
+		w.dec = nil
+		dec.Close()
+	}
+}
+
+// writeDecoded handles the decoded body, unless decoding was stopped.
+func (w *ResponseWriter) writeDecoded(b []byte) (int, error) {
+	if w.dec == nil {
+		return len(b), nil
+	}
+	return w.write(b)
+}
+
+// passPending sends the bytes held back uncompressed, once the response is
+// skipped.
+func (w *ResponseWriter) passPending() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	b := w.pending
+	w.pending = nil
+	_, err := w.write(b)
+	return err
+}
+
+// detectContentType returns the Content-Type of a body starting with b.
+func (w *ResponseWriter) detectContentType(b []byte) string {
+	if w.sniffLength > 0 && len(b) > w.sniffLength {
+		b = b[:w.sniffLength]
+	}
+	if w.sniff != nil {
+		if ct := w.sniff(b); ct != "" {
+			return ct
+		}
+	}
+	return http.DetectContentType(b)
+}
+
+// ReadFrom implements io.ReaderFrom. When the response is not compressed it
+// defers to the underlying writer, keeping the sendfile path of
+// http.ResponseWriter available to io.Copy. Handlers wrapped with Wrap reach
+// it through io.Copy; route.Response does not implement io.ReaderFrom, so
+// route handlers, c.File included, only reach it through
+// c.Response().Writer.
+func (w *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.lock()
+	if w.gw == nil && !w.hijacked && !w.shadow && !w.decoding() && w.passthrough() {
+		defer w.unlock()
+		w.writeHeader()
+		var n int64
+		var err error
+		if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+			n, err = rf.ReadFrom(r)
+		} else {
+			n, err = io.Copy(writerOnly{w.ResponseWriter}, r)
+		}
+		w.size += n
+		w.wire += n
+		return n, err
+	}
+	w.unlock()
+	return io.Copy(writerOnly{w}, r)
+}
+
+func (w *ResponseWriter) Flush() {
+	w.FlushError()
+}
+
+// FlushError flushes buffered data to the client like Flush and reports any
+// error. http.ResponseController prefers it over Flush.
+func (w *ResponseWriter) FlushError() error {
+	w.lock()
+	defer w.unlock()
+	return w.flush()
+}
+
+// flush implements FlushError.
+func (w *ResponseWriter) flush() error {
+	if err := w.req.Context().Err(); err != nil {
+		w.abort()
+		return w.fault(OpFlush, err)
+	}
+	if err := w.decide(); err != nil {
+		return err
+	}
+	if w.buf != nil {
+		if err := w.release(); err != nil {
+			return w.fault(OpFlush, err)
+		}
+	}
+	if w.gw != nil {
+		t := time.Now()
+		err := w.gw.Flush()
+		w.elapsed += time.Since(t)
+		if err != nil {
+			return w.fault(OpFlush, err)
+		}
+	} else {
+		w.writeHeader()
+	}
+	if w.flushPending {
+		// This flush sends what the timer was due to.
+		w.flushPending = false
+		w.flushTimer.Stop()
+	}
+	t := time.Now()
+	defer func() {
+		w.flushTook = time.Since(t)
+	}()
+	switch f := w.ResponseWriter.(type) {
+	case interface{ FlushError() error }:
+		return w.fault(OpFlush, w.sent(f.FlushError()))
+	case http.Flusher:
+		f.Flush()
+	}
+	return nil
+}
+
+// decide settles whether the response is compressed with what was written so
+// far, as a flush needs to. The status is sent unless the response is
+// buffered.
+func (w *ResponseWriter) decide() error {
+	if w.gw != nil || w.wroteHeader || w.passthrough() {
+		return nil
+	}
+	if len(w.pending) > 0 && w.Header().Get(route.HeaderContentType) == "" {
+		w.Header().Set(route.HeaderContentType, w.detectContentType(w.pending))
+	}
+	w.checked = true
+	if w.skipped = w.skip(); w.skipped == 0 {
+		if err := w.start(); err != nil {
+			return w.fault(OpInit, err)
+		}
+	} else if err := w.passPending(); err != nil {
+		return w.fault(OpFlush, err)
+	}
+	return nil
+}
+
+// Hijack lets the handler take over the connection. Whatever was compressed
+// so far is flushed, the gzip writer goes back to the pool without writing a
+// trailer and content-coding headers are removed, since the handler now
+// speaks to the client directly.
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.lock()
+	defer w.unlock()
+	w.cancelFlush()
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, ErrHijackNotSupported
+	}
+	// The decoder may run without gzip, for clients that do not accept it.
+	w.stopDecoding()
+	if w.gw != nil {
+		w.gw.Flush()
+		if w.buf != nil {
+			w.release()
+		}
+		w.discard()
+	}
+	w.Header().Del(route.HeaderContentEncoding)
+	w.hijacked = true
+	return hj.Hijack()
+}
+
+// Unwrap returns the underlying writer so http.ResponseController can reach
+// it through the middleware.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Active reports whether the body is being compressed. It is false until the
+// first byte of the body is written, and for responses passed through.
+func (w *ResponseWriter) Active() bool {
+	return w.encoding != ""
+}
+
+// Encoding returns the content coding applied to the body, empty while
+// Active is false.
+func (w *ResponseWriter) Encoding() Encoding {
+	return w.encoding
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+func (w *ResponseWriter) SetReadDeadline(deadline time.Time) error {
+	return http.NewResponseController(w.ResponseWriter).SetReadDeadline(deadline)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection, which
+// lets streaming handlers extend it while the response is being compressed.
+func (w *ResponseWriter) SetWriteDeadline(deadline time.Time) error {
+	return http.NewResponseController(w.ResponseWriter).SetWriteDeadline(deadline)
+}
+
+// EnableFullDuplex allows the handler to read the request body after it has
+// started writing the response.
+func (w *ResponseWriter) EnableFullDuplex() error {
+	return http.NewResponseController(w.ResponseWriter).EnableFullDuplex()
+}
+
+// CloseNotify implements the deprecated http.CloseNotifier for handlers that
+// still rely on it. If the underlying writer does not support it the returned
+// channel never receives.
+func (w *ResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return nil
+}
+
+// lock and unlock serialize the handler with timed flushes, if FlushInterval
+// is set.
+func (w *ResponseWriter) lock() {
+	if w.flushInterval > 0 {
+		w.mu.Lock()
+	}
+}
+
+func (w *ResponseWriter) unlock() {
+	if w.flushInterval > 0 {
+		w.mu.Unlock()
+	}
+}
+
+// scheduleFlush arms the flush timer after a write, unless a flush is
+// already due. It is called with the lock held.
+func (w *ResponseWriter) scheduleFlush() {
+	if w.flushInterval == 0 || w.flushPending || w.flushStopped || w.hijacked {
+		return
+	}
+	if w.checkFlush(); !w.timed {
+		return
+	}
+	if !w.wroteHeader {
+		// The timer must not touch the header map, which the handler may
+		// change until the status is sent, so it is sent here first. A
+		// buffered response is flushed on time once it is released.
+		if w.buf != nil || w.decide() != nil {
+			return
+		}
+		w.writeHeader()
+	}
+	// A client slower to take a flush than the interval is flushed no more
+	// often than it keeps up with, so that the timer never queues flushes
+	// behind one still blocked.
+	d := w.flushInterval
+	if w.flushTook > d {
+		d = w.flushTook
+	}
+	w.flushPending = true
+	if w.flushTimer == nil {
+		w.flushTimer = time.AfterFunc(d, w.delayedFlush)
+	} else {
+		w.flushTimer.Reset(d)
+	}
+}
+
+// delayedFlush runs on the flush timer.
+func (w *ResponseWriter) delayedFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.flushPending || w.flushStopped {
+		return
+	}
+	w.flush()
+}
+
+// cancelFlush stops timed flushes for good. It is called with the lock held.
+func (w *ResponseWriter) cancelFlush() {
+	w.flushStopped = true
+	if w.flushTimer != nil {
+		w.flushTimer.Stop()
+	}
+}
+
+// stopFlush stops timed flushes once the handler has returned, so that the
+// response can be completed without the lock.
+func (w *ResponseWriter) stopFlush() {
+	if w.flushInterval > 0 {
+		w.mu.Lock()
+		w.cancelFlush()
+		w.mu.Unlock()
+	}
+}
+
+// start switches the response to gzip. The status is sent right away unless
+// the response is being buffered.
+func (w *ResponseWriter) start() error {
+	if v := w.pool.Get(); v != nil {
+		w.gw = v.(*gzip.Writer)
+		w.gw.Reset(writerFunc(w.writeCompressed))
+	} else {
+		gw, err := gzip.NewWriterLevel(writerFunc(w.writeCompressed), w.level)
+		if err != nil {
+			return err
+		}
+		w.gw = gw
+	}
+	if w.padding > 0 {
+		w.gw.Name = filler(w.padding)
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.encoding = EncodingGzip
+	h := w.Header()
+	h.Set(route.HeaderContentEncoding, string(EncodingGzip))
+	// A length set by the handler counts uncompressed bytes. It is kept to
+	// check the body against and replaced by the compressed length once
+	// known, or dropped when the response is streamed.
+	if cl := h.Get(route.HeaderContentLength); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			w.declared = n
+			if w.lengthHdr != "" {
+				h.Set(w.lengthHdr, cl)
+			}
+		}
+		h.Del(route.HeaderContentLength)
+	}
+	if w.h2 {
+		// HTTP/2 has no chunked transfer coding; the header is invalid there.
+		h.Del(headerTransferEncoding)
+	}
+	adjustETag(h, w.etag, EncodingGzip)
+	if w.code != http.StatusOK {
+		w.buf = nil
+	}
+	if w.buf == nil {
+		w.writeHeader()
+	}
+	if len(w.pending) > 0 {
+		b := w.pending
+		w.pending = nil
+		n, err := w.gw.Write(b)
+		w.size += int64(n)
+		return w.fault(OpWrite, err)
+	}
+	return nil
+}
+
+// measure compresses b in shadow mode and counts the compressed bytes. It
+// reports false, and leaves shadow mode, if the body is not one that would
+// have been compressed.
+func (w *ResponseWriter) measure(b []byte) bool {
+	if w.sgw == nil {
+		if !w.bodyAllowed(w.code) || isUpgrade(w.Header()) {
+			w.shadow = false
+			return false
+		}
+		if w.skipped = w.skip(); w.skipped != 0 {
+			w.shadow = false
+			return false
+		}
+		count := writerFunc(func(p []byte) (int, error) {
+			w.wire += int64(len(p))
+			return len(p), nil
+		})
+		if v := w.pool.Get(); v != nil {
+			w.sgw = v.(*gzip.Writer)
+			w.sgw.Reset(count)
+		} else {
+			gw, err := gzip.NewWriterLevel(count, w.level)
+			if err != nil {
+				w.shadow = false
+				return false
+			}
+			w.sgw = gw
+		}
+		w.encoding = EncodingGzip
+	}
+	t := time.Now()
+	w.sgw.Write(b)
+	w.elapsed += time.Since(t)
+	return true
+}
+
+// filler returns a random string of 1 to max lowercase letters.
+func filler(max int) string {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return ""
+	}
+	return letters(int(n.Int64()) + 1)
+}
+
+// letters returns a string of n random lowercase letters.
+func letters(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	for i := range b {
+		b[i] = 'a' + b[i]%26
+	}
+	return string(b)
+}
+
+// setPadding sets the padding header to the length that rounds the
+// compressed body and padding up to the next multiple of lengthPadding.
+func (w *ResponseWriter) setPadding() {
+	n := w.lengthPadding - int(w.wire%int64(w.lengthPadding))
+	w.Header().Set(HeaderPadding, letters(n))
+}
+
+// skip returns why the body about to be written should be passed through
+// as is, 0 if it should be compressed.
+func (w *ResponseWriter) skip() SkipReason {
+	h := w.Header()
+	if ce := h.Get(route.HeaderContentEncoding); ce != "" && !strings.EqualFold(ce, string(EncodingIdentity)) {
+		return SkipAlreadyEncoded
+	}
+	if w.sensitive != nil && w.sensitive() {
+		return SkipSensitive
+	}
+	if w.skipSetCookie && len(h[headerSetCookie]) > 0 {
+		return SkipResponseCookies
+	}
+	for _, v := range h[headerCacheControl] {
+		for _, d := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), "no-transform") {
+				return SkipNoTransform
+			}
+		}
+	}
+	if len(w.excluded) > 0 {
+		mt, _, _ := mime.ParseMediaType(h.Get(route.HeaderContentType))
+		for _, t := range w.excluded {
+			t = strings.ToLower(strings.TrimSuffix(t, "*"))
+			if mt == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mt, t) {
+				return SkipExcludedContentType
+			}
+		}
+	}
+	if cl := h.Get(route.HeaderContentLength); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n < int64(w.minLength) {
+			return SkipBelowMinLength
+		}
+	}
+	return 0
+}
+
+// finish completes the response after the handler has returned. A response
+// without body is sent as is; otherwise the gzip stream is closed and its
+// writer returned to the pool. It returns the first error the response ran
+// into.
+func (w *ResponseWriter) finish() error {
+	if w.hijacked {
+		return w.err
+	}
+	if w.dec != nil {
+		err := w.dec.Close()
+		w.dec = nil
+		w.fault(OpWrite, err)
+	}
+	if w.sgw != nil {
+		t := time.Now()
+		w.sgw.Close()
+		w.elapsed += time.Since(t)
+		w.sgw.Reset(ioutil.Discard)
+		w.pool.Put(w.sgw)
+		w.sgw = nil
+		if w.size < int64(w.minLength) {
+			// Measured, but shorter than MinLength after all.
+			w.shadow = false
+			w.skipped = SkipBelowMinLength
+			w.encoding = ""
+			w.wire = w.size
+			w.elapsed = 0
+		}
+	}
+	if w.gw == nil && len(w.pending) > 0 {
+		// The whole body was held back.
+		b := w.pending
+		w.pending = nil
+		if w.Header().Get(route.HeaderContentType) == "" {
+			w.Header().Set(route.HeaderContentType, w.detectContentType(b))
+		}
+		if len(b) < w.minLength {
+			w.skipped = SkipBelowMinLength
+		}
+		if _, err := w.write(b); err != nil {
+			return w.fault(OpClose, err)
+		}
+	}
+	if w.gw == nil {
+		if w.req.Method == http.MethodHead && !w.checked {
+			w.encodeHead()
+		}
+		if w.code != 0 {
+			w.writeHeader()
+		}
+		return w.err
+	}
+	if err := w.req.Context().Err(); err != nil {
+		w.abort()
+		return w.fault(OpClose, err)
+	}
+	t := time.Now()
+	w.fault(OpClose, w.gw.Close())
+	w.elapsed += time.Since(t)
+	w.gw.Reset(ioutil.Discard)
+	w.pool.Put(w.gw)
+	w.closed = true
+	if w.buf != nil {
+		w.fault(OpClose, w.finishBuffer())
+		return w.err
+	}
+	if w.statsTrailers {
+		w.setStats()
+	}
+	if w.debug {
+		w.Header().Set(HeaderCompress, debugValue(w.stats()))
+	}
+	if w.lengthPadding > 0 {
+		w.setPadding()
+	}
+	return w.err
+}
+
+// encodeHead gives a response to a HEAD request without body the content
+// coding headers the same response to GET would get, as far as its headers
+// tell: compressing a body of unknown length depends on MinLength, and one
+// of unknown type on ExcludedContentTypes.
+func (w *ResponseWriter) encodeHead() {
+	if w.wroteHeader || w.passthrough() {
+		return
+	}
+	h := w.Header()
+	cl := h.Get(route.HeaderContentLength)
+	if cl == "" && w.minLength > 0 || h.Get(route.HeaderContentType) == "" && len(w.excluded) > 0 {
+		return
+	}
+	w.checked = true
+	if w.skipped = w.skip(); w.skipped != 0 {
+		return
+	}
+	w.encoding = EncodingGzip
+	h.Set(route.HeaderContentEncoding, string(EncodingGzip))
+	if cl != "" {
+		if w.lengthHdr != "" {
+			h.Set(w.lengthHdr, cl)
+		}
+		h.Del(route.HeaderContentLength)
+	}
+	if w.h2 {
+		h.Del(headerTransferEncoding)
+	}
+	adjustETag(h, w.etag, EncodingGzip)
+}
+
+// fault wraps an error hit during op in an *Error, records the first one of
+// the response and returns it.
+func (w *ResponseWriter) fault(op Op, err error) error {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		// Already reported at a finer step.
+		return e
+	}
+	e := &Error{
+		Op:     op,
+		Client: errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || w.connErr != nil && errors.Is(err, w.connErr),
+		Err:    err,
+	}
+	if w.err == nil {
+		w.err = e
+	}
+	return e
+}
+
+// sent records an error returned by the underlying writer and returns it.
+func (w *ResponseWriter) sent(err error) error {
+	if err != nil && w.connErr == nil {
+		w.connErr = err
+	}
+	return err
+}
+
+// setStats sets the compression statistics headers. They are declared as
+// trailers when the response is streamed.
+func (w *ResponseWriter) setStats() {
+	h := w.Header()
+	h.Set(HeaderOriginalLength, strconv.FormatInt(w.size, 10))
+	if w.size > 0 {
+		h.Set(HeaderCompressionRatio, strconv.FormatFloat(float64(w.wire)/float64(w.size), 'f', 3, 64))
+	}
+}
+
+// fail completes the response after the handler returned an error. A buffered
+// response that has not been sent is dropped and fail reports true. A
+// response that is already streaming is closed cleanly or, with truncate,
+// cut off without its gzip trailer.
+func (w *ResponseWriter) fail(truncate bool) bool {
+	if (w.gw != nil || len(w.pending) > 0) && w.buf != nil && !w.wroteHeader {
+		w.abort()
+		w.code = 0
+		return true
+	}
+	if truncate && (w.gw != nil || len(w.pending) > 0) {
+		w.FlushError()
+		w.discard()
+		return false
+	}
+	w.finish()
+	return false
+}
+
+// abort releases the gzip writer without completing the response. If nothing
+// has been sent yet the response is left without content coding, so that
+// whoever handles the failure can still write an uncompressed reply.
+func (w *ResponseWriter) abort() {
+	w.discard()
+	w.buf = nil
+	w.pending = nil
+	if !w.wroteHeader {
+		w.Header().Del(route.HeaderContentEncoding)
+	}
+}
+
+// discard returns the gzip writers to the pool without writing a trailer.
+func (w *ResponseWriter) discard() {
+	w.stopDecoding()
+	if w.sgw != nil {
+		w.sgw.Reset(ioutil.Discard)
+		w.pool.Put(w.sgw)
+		w.sgw = nil
+		if w.size < int64(w.minLength) {
+			// Measured, but shorter than MinLength after all.
+			w.shadow = false
+			w.skipped = SkipBelowMinLength
+			w.encoding = ""
+			w.wire = w.size
+			w.elapsed = 0
+		}
+	}
+	if w.gw == nil {
+		return
+	}
+	w.gw.Reset(ioutil.Discard)
+	w.pool.Put(w.gw)
+	w.gw = nil
+}
+
+// writeHeader sends the status set by the handler once.
+func (w *ResponseWriter) writeHeader() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	h := w.Header()
+	if w.vary && w.bodyAllowed(w.code) {
+		setVary(h, w.varyStrategy)
+	}
+	if w.statsTrailers && w.gw != nil && !w.closed {
+		h.Add(headerTrailer, HeaderOriginalLength+", "+HeaderCompressionRatio)
+	}
+	if w.debug {
+		if w.gw == nil && w.encoding == "" {
+			h.Set(HeaderCompress, string(EncodingIdentity)+";reason="+w.skipReason().String())
+		} else if !w.closed {
+			h.Add(headerTrailer, HeaderCompress)
+		}
+	}
+	if w.lengthPadding > 0 && w.gw != nil && !w.closed {
+		h.Add(headerTrailer, HeaderPadding)
+	}
+	// The status may go out well after the handler called WriteHeader, so
+	// values it already set for declared trailers are held back to keep them
+	// from being sent as headers too.
+	var held http.Header
+	for _, v := range h[headerTrailer] {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if vv, ok := h[k]; ok {
+				if held == nil {
+					held = make(http.Header)
+				}
+				held[k] = vv
+				delete(h, k)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	for k, vv := range held {
+		h[k] = vv
+	}
+}
+
+// writeCompressed receives the output of the gzip writer and either buffers it
+// or passes it on to the client.
+func (w *ResponseWriter) writeCompressed(b []byte) (int, error) {
+	w.wire += int64(len(b))
+	if w.buf != nil {
+		if w.buf.Len()+len(b) <= w.maxBuf {
+			return w.buf.Write(b)
+		}
+		if err := w.release(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.ResponseWriter.Write(b)
+	return n, w.sent(err)
+}
+
+// release stops buffering and sends the held status and body.
+func (w *ResponseWriter) release() error {
+	buf := w.buf
+	w.buf = nil
+	w.writeHeader()
+	_, err := w.ResponseWriter.Write(buf.Bytes())
+	return w.sent(err)
+}
+
+// finishBuffer sends a response that is still buffered after the gzip writer
+// has been closed with its exact Content-Length. When computing ETags a
+// matching If-None-Match is answered with 304 Not Modified.
+func (w *ResponseWriter) finishBuffer() error {
+	if w.computeETag {
+		sum := sha256.Sum256(w.buf.Bytes())
+		etag := fmt.Sprintf(`"%x"`, sum[:16])
+		w.Header().Set(headerETag, etag)
+		if etagMatch(w.req.Header.Get(headerIfNoneMatch), etag) {
+			w.buf = nil
+			w.wire = 0
+			w.encoding = ""
+			w.Header().Del(route.HeaderContentEncoding)
+			w.Header().Del(route.HeaderContentType)
+			w.code = http.StatusNotModified
+			w.writeHeader()
+			return nil
+		}
+	}
+	if w.lengthHdr != "" {
+		w.Header().Set(w.lengthHdr, strconv.FormatInt(w.size, 10))
+	}
+	if w.statsTrailers {
+		w.setStats()
+	}
+	if w.debug {
+		w.Header().Set(HeaderCompress, debugValue(w.stats()))
+	}
+	if w.lengthPadding > 0 {
+		w.setPadding()
+	}
+	if len(w.digests) > 0 {
+		setDigest(w.Header(), w.digests, w.buf.Bytes())
+	}
+	if !hasTrailers(w.Header()) {
+		// Trailers need chunked transfer encoding.
+		w.Header().Set(route.HeaderContentLength, strconv.Itoa(w.buf.Len()))
+	}
+	return w.release()
+}
+
+// setDigest sets Content-Digest and Repr-Digest (RFC 9530) for body using the
+// listed algorithms. Unknown algorithms are ignored.
+func setDigest(h http.Header, algorithms []string, body []byte) {
+	var fields []string
+	for _, alg := range algorithms {
+		newHash, ok := digestAlgorithms[strings.ToLower(alg)]
+		if !ok {
+			continue
+		}
+		d := newHash()
+		d.Write(body)
+		fields = append(fields, strings.ToLower(alg)+"=:"+base64.StdEncoding.EncodeToString(d.Sum(nil))+":")
+	}
+	if len(fields) == 0 {
+		return
+	}
+	v := strings.Join(fields, ", ")
+	h.Set(headerContentDigest, v)
+	h.Set(headerReprDigest, v)
+}
+
+// hasTrailers reports whether h declares trailers, either in the Trailer header
+// or with keys prefixed by http.TrailerPrefix.
+func hasTrailers(h http.Header) bool {
+	if _, ok := h[headerTrailer]; ok {
+		return true
+	}
+	for k := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// passthrough reports whether the body is sent as written: the client does not
+// accept gzip, the status has no body or the response upgrades the connection
+// to another protocol.
+func (w *ResponseWriter) passthrough() bool {
+	return w.identity || w.skipped != 0 || !w.bodyAllowed(w.code) || isUpgrade(w.Header())
+}
+
+// isUpgrade reports whether h carries an Upgrade header or a Connection header
+// with the upgrade option.
+func isUpgrade(h http.Header) bool {
+	if h.Get(route.HeaderUpgrade) != "" {
+		return true
+	}
+	for _, v := range h[headerConnection] {
+		for _, opt := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(opt), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bodyAllowed reports whether a response with status code may carry a body.
+// Such responses are never compressed.
+func (w *ResponseWriter) bodyAllowed(code int) bool {
+	if code >= 100 && code < 200 {
+		return false
+	}
+	return !w.bodyless[code]
+}
+
+// etagMatch reports whether the If-None-Match list matches etag using the weak
+// comparison function.
+func etagMatch(list, etag string) bool {
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// adjustETag rewrites a strong ETag in h according to strategy. Weak ETags
+// already allow for a different encoding of the same content and are kept.
+func adjustETag(h http.Header, strategy ETagStrategy, encoding Encoding) {
+	etag := h.Get(headerETag)
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return
+	}
+	switch strategy {
+	case ETagWeaken:
+		h.Set(headerETag, "W/"+etag)
+	case ETagSuffix:
+		if strings.HasSuffix(etag, `"`) {
+			h.Set(headerETag, strings.TrimSuffix(etag, `"`)+"-"+string(encoding)+`"`)
+		}
+	}
+}